@@ -0,0 +1,196 @@
+package dht
+
+import (
+	"errors"
+	"net"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// privateNets are the address ranges that are not reachable from the public
+// internet.
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		privateNets = append(privateNets, ipnet)
+	}
+}
+
+// addrIP returns the IP address a multiaddr starts with, or nil if it has
+// none (e.g. a dns or relay address).
+func addrIP(a ma.Multiaddr) net.IP {
+	if v, err := a.ValueForProtocol(ma.P_IP4); err == nil {
+		return net.ParseIP(v)
+	}
+	if v, err := a.ValueForProtocol(ma.P_IP6); err == nil {
+		return net.ParseIP(v)
+	}
+	return nil
+}
+
+// isPublicIP reports whether ip is reachable from the public internet.
+func isPublicIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ipPrefix returns the network prefix used to group addresses that are
+// likely run by the same operator: the /24 for IPv4 and the /48 for IPv6.
+// It returns "" for addresses that are not public.
+func ipPrefix(ip net.IP) string {
+	if !isPublicIP(ip) {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// addrPrefixes returns the distinct public network prefixes of addrs.
+func addrPrefixes(addrs []ma.Multiaddr) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, a := range addrs {
+		pfx := ipPrefix(addrIP(a))
+		if pfx == "" || seen[pfx] {
+			continue
+		}
+		seen[pfx] = true
+		out = append(out, pfx)
+	}
+	return out
+}
+
+// AddrFilter returns the addresses in addrs that may be shared with peer to.
+type AddrFilter func(to peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr
+
+// address scopes, from widest to narrowest reach
+const (
+	scopePublic = iota
+	scopePrivate
+	scopeLoopback
+)
+
+// addrScope returns the scope of a, non-IP addresses (e.g. dns) are public.
+func addrScope(a ma.Multiaddr) int {
+	ip := addrIP(a)
+	switch {
+	case ip == nil:
+		return scopePublic
+	case ip.IsLoopback() || ip.IsUnspecified():
+		return scopeLoopback
+	case !isPublicIP(ip):
+		return scopePrivate
+	default:
+		return scopePublic
+	}
+}
+
+// LANAwareAddrFilter returns an AddrFilter that only shares loopback
+// addresses with peers connected over loopback, and private addresses with
+// peers connected over a private network. Peers we are not connected to
+// only get public addresses.
+func LANAwareAddrFilter(n inet.Network) AddrFilter {
+	return func(to peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+		scope := scopePublic
+		for _, c := range n.ConnsToPeer(to) {
+			if s := addrScope(c.RemoteMultiaddr()); s > scope {
+				scope = s
+			}
+		}
+
+		var out []ma.Multiaddr
+		for _, a := range addrs {
+			if addrScope(a) <= scope {
+				out = append(out, a)
+			}
+		}
+		return out
+	}
+}
+
+// SetAddrFilter makes the dht only share the addresses f returns with other
+// peers, or all addresses if f is nil. By default, the dht uses a
+// LANAwareAddrFilter.
+func (dht *IpfsDHT) SetAddrFilter(f AddrFilter) {
+	dht.filterlk.Lock()
+	defer dht.filterlk.Unlock()
+	dht.addrFilter = f
+}
+
+// filterPeerInfo returns pi with only the addresses we may share with to.
+func (dht *IpfsDHT) filterPeerInfo(to peer.ID, pi pstore.PeerInfo) pstore.PeerInfo {
+	dht.filterlk.RLock()
+	f := dht.addrFilter
+	dht.filterlk.RUnlock()
+
+	if f == nil {
+		return pi
+	}
+	return pstore.PeerInfo{
+		ID:    pi.ID,
+		Addrs: f(to, pi.Addrs),
+	}
+}
+
+// peerInfosToPBPeers encodes peer infos for a message to peer to, leaving out
+// the addresses we may not share with it, and hinting at whether we can
+// connect to each peer.
+func (dht *IpfsDHT) peerInfosToPBPeers(to peer.ID, infos []pstore.PeerInfo) []*pb.Message_Peer {
+	filtered := make([]pstore.PeerInfo, len(infos))
+	for i, pi := range infos {
+		filtered[i] = dht.filterPeerInfo(to, pi)
+	}
+	return dht.encodePeerInfos(filtered)
+}
+
+// encodePeerInfos encodes peer infos whose addresses were filtered already,
+// hinting at whether we can connect to each peer.
+func (dht *IpfsDHT) encodePeerInfos(infos []pstore.PeerInfo) []*pb.Message_Peer {
+	pbps := pb.RawPeerInfosToPBPeers(infos)
+	for i, pbp := range pbps {
+		c := dht.connectionType(infos[i].ID)
+		pbp.Connection = &c
+	}
+	return pbps
+}
+
+// errNoSharedAddrs is returned when none of our addresses may be shared with
+// a peer we want to announce ourselves to.
+var errNoSharedAddrs = errors.New("no addresses to share with peer")
+
+// providerPBPeers encodes pi, our provider info, for an announcement to peer
+// to. Announcements without addresses are dropped by their recipients, so
+// it fails if none of our addresses may be shared with to.
+func (dht *IpfsDHT) providerPBPeers(to peer.ID, pi pstore.PeerInfo) ([]*pb.Message_Peer, error) {
+	pi = dht.filterPeerInfo(to, pi)
+	if len(pi.Addrs) == 0 {
+		return nil, errNoSharedAddrs
+	}
+	return pb.RawPeerInfosToPBPeers([]pstore.PeerInfo{pi}), nil
+}
@@ -0,0 +1,117 @@
+package dht
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Capabilities of the DHT protocol that peers advertise in PING responses.
+// Peers that answer a PING without capabilities support none of them.
+const (
+	// CapBatchProvide is support for announcing several keys in one
+	// ADD_PROVIDER message.
+	CapBatchProvide = "batch-provide"
+
+	// CapErrorResponses is support for error codes in responses.
+	CapErrorResponses = "error-responses"
+
+	// CapRequestIDs is support for pipelining requests by request ID.
+	CapRequestIDs = "request-ids"
+)
+
+var builtinCapabilities = []string{CapBatchProvide, CapErrorResponses, CapRequestIDs}
+
+const (
+	// number of peers we remember the capabilities of
+	capabilitiesCacheSize = 4096
+
+	// how long we wait for a newly connected peer to tell its capabilities
+	capabilitiesPingTimeout = 10 * time.Second
+)
+
+func newCapabilitiesCache() *lru.Cache {
+	caps, err := lru.New(capabilitiesCacheSize)
+	if err != nil {
+		panic(err) //only happens if negative value is passed to lru constructor
+	}
+	return caps
+}
+
+// AdvertiseCapability adds c to the capabilities we advertise to other peers,
+// e.g. for messages handled by a registered handler.
+func (dht *IpfsDHT) AdvertiseCapability(c string) {
+	dht.caplk.Lock()
+	defer dht.caplk.Unlock()
+	dht.caps[c] = true
+}
+
+// capabilities returns the capabilities we advertise, sorted.
+func (dht *IpfsDHT) capabilities() []string {
+	dht.caplk.Lock()
+	defer dht.caplk.Unlock()
+
+	out := make([]string, 0, len(dht.caps))
+	for c := range dht.caps {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// PeerCapabilities returns the capabilities p advertised, and whether p told
+// us yet.
+func (dht *IpfsDHT) PeerCapabilities(p peer.ID) ([]string, bool) {
+	v, ok := dht.peerCaps.Get(p)
+	if !ok {
+		return nil, false
+	}
+	caps := v.(map[string]bool)
+
+	out := make([]string, 0, len(caps))
+	for c := range caps {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return out, true
+}
+
+// learnCapabilities records the capabilities p advertised.
+func (dht *IpfsDHT) learnCapabilities(p peer.ID, caps []string) {
+	m := make(map[string]bool, len(caps))
+	for _, c := range caps {
+		m[c] = true
+	}
+	dht.peerCaps.Add(p, m)
+}
+
+// peerHasCapability reports whether p told us it supports c.
+func (dht *IpfsDHT) peerHasCapability(p peer.ID, c string) bool {
+	v, ok := dht.peerCaps.Get(p)
+	return ok && v.(map[string]bool)[c]
+}
+
+// peerLacksCapability reports whether p told us its capabilities, and c is
+// not among them. Features are still tried with peers we know nothing about.
+func (dht *IpfsDHT) peerLacksCapability(p peer.ID, c string) bool {
+	v, ok := dht.peerCaps.Get(p)
+	return ok && !v.(map[string]bool)[c]
+}
+
+// exchangeCapabilities pings p, which answers with its capabilities, unless
+// we know them already.
+func (dht *IpfsDHT) exchangeCapabilities(p peer.ID) {
+	if dht.peerCaps.Contains(p) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(dht.Context(), capabilitiesPingTimeout)
+	defer cancel()
+
+	if err := dht.ping(ctx, p); err != nil {
+		log.Debugf("asking %s for its capabilities: %s", p, err)
+	}
+}
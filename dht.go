@@ -15,11 +15,13 @@ import (
 	routing "github.com/libp2p/go-libp2p-routing"
 
 	proto "github.com/gogo/protobuf/proto"
+	lru "github.com/hashicorp/golang-lru"
 	cid "github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	logging "github.com/ipfs/go-log"
 	goprocess "github.com/jbenet/goprocess"
 	goprocessctx "github.com/jbenet/goprocess/context"
+	periodicproc "github.com/jbenet/goprocess/periodic"
 	ci "github.com/libp2p/go-libp2p-crypto"
 	host "github.com/libp2p/go-libp2p-host"
 	kb "github.com/libp2p/go-libp2p-kbucket"
@@ -50,6 +52,8 @@ type IpfsDHT struct {
 	datastore ds.Datastore // Local data
 
 	routingTable *kb.RoutingTable // Array of routing tables for differently distanced nodes
+	rtstate      *rtState         // bookkeeping for routingTable, guarded by rtlk
+	rtlk         sync.Mutex
 	providers    *providers.ProviderManager
 
 	birth time.Time // When this peer started up
@@ -57,17 +61,68 @@ type IpfsDHT struct {
 	Validator record.Validator // record validator funcs
 	Selector  record.Selector  // record selection funcs
 
-	ctx  context.Context
-	proc goprocess.Process
+	peerFilter PeerFilter // peers allowed to take part in routing, nil allows all
+	addrFilter AddrFilter // addresses we share with a given peer, nil shares all
+	filterlk   sync.RWMutex
 
-	strmap map[peer.ID]*messageSender
-	smlk   sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc // cancels ctx, on Close
+	proc   goprocess.Process
+
+	work     sync.WaitGroup // in-flight work Close waits for
+	worklk   sync.Mutex
+	shutdown bool // set by Close, guarded by worklk
+	serving  bool // whether we registered our stream handlers, guarded by worklk
+
+	strmap    map[peer.ID]*senderPool
+	smlk      sync.Mutex
+	poolStats *StreamPoolStats // updated atomically
+
+	// peers known not to support batched ADD_PROVIDER messages
+	noBatchProvide *lru.Cache
+
+	probeq chan peer.ID // newly connected peers to check for dht support
+	noDHT  *lru.Cache   // peers known not to be full dht nodes, until the stored time
+
+	dials *dialHistory // recent dials, for connection hints in responses
+
+	limiter *rateLimiter  // limits on the requests we serve
+	dsSlots chan struct{} // datastore calls of handlers, see dsCall
+
+	handlers map[pb.Message_MessageType]MessageHandler // registered message types
+	hlk      sync.RWMutex
+
+	caps     map[string]bool // capabilities we advertise
+	caplk    sync.Mutex
+	peerCaps *lru.Cache // peer.ID -> map[string]bool, as the peer advertised them
+
+	msgLimits  MessageLimitsConfig // guarded by limitlk
+	limitlk    sync.RWMutex
+	limitStats *MessageLimitStats // updated atomically
+
+	negcache negCacheHolder
+
+	rtsnap    RTSnapshotConfig // routing table persistence settings, guarded by rtsnaplk
+	rtsnaplk  sync.Mutex
+	rtseeded  bool          // whether seeding from the snapshot was started
+	rtsnapset chan struct{} // signals the snapshot loop that the settings changed
+
+	lastLookup map[int]time.Time // last lookup per bucket, by common prefix length
+	lookuplk   sync.Mutex
 }
 
-// NewDHT creates a new DHT object with the given peer as the 'local' host
+// NewDHT creates a new DHT object with the given peer as the 'local' host.
+// It takes over the host's DHT protocol handlers, and removes them on Close,
+// so a host must not be shared with another DHT that serves requests.
 func NewDHT(ctx context.Context, h host.Host, dstore ds.Batching) *IpfsDHT {
 	dht := NewDHTClient(ctx, h, dstore)
 
+	dht.worklk.Lock()
+	defer dht.worklk.Unlock()
+	if dht.shutdown {
+		return dht
+	}
+	dht.serving = true
 	h.SetStreamHandler(ProtocolDHT, dht.handleNewStream)
 	h.SetStreamHandler(ProtocolDHTOld, dht.handleNewStream)
 
@@ -82,12 +137,27 @@ func NewDHTClient(ctx context.Context, h host.Host, dstore ds.Batching) *IpfsDHT
 	dht.host.Network().Notify((*netNotifiee)(dht))
 
 	dht.proc = goprocessctx.WithContextAndTeardown(ctx, func() error {
+		// we get here without Close when ctx is cancelled
+		dht.stopAccepting()
+		dht.cancel()
+
 		// remove ourselves from network notifs.
 		dht.host.Network().StopNotify((*netNotifiee)(dht))
+
+		if err := dht.saveRoutingTable(); err != nil {
+			log.Warningf("saving routing table: %s", err)
+		}
+
+		dht.closeMessageSenders()
 		return nil
 	})
 
 	dht.proc.AddChild(dht.providers.Process())
+	dht.startProbeWorkers()
+	dht.proc.AddChild(periodicproc.Tick(senderSweepInterval, func(goprocess.Process) {
+		dht.sweepIdleSenders()
+	}))
+	dht.startRTSnapshots()
 
 	dht.Validator["pk"] = record.PublicKeyValidator
 	dht.Selector["pk"] = record.PublicKeySelector
@@ -96,19 +166,53 @@ func NewDHTClient(ctx context.Context, h host.Host, dstore ds.Batching) *IpfsDHT
 }
 
 func makeDHT(ctx context.Context, h host.Host, dstore ds.Batching) *IpfsDHT {
+	noBatchProvide, err := lru.New(noBatchProvideCacheSize)
+	if err != nil {
+		panic(err) //only happens if negative value is passed to lru constructor
+	}
+	noDHT, err := lru.New(noDHTCacheSize)
+	if err != nil {
+		panic(err)
+	}
+
+	caps := make(map[string]bool)
+	for _, c := range builtinCapabilities {
+		caps[c] = true
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
 	return &IpfsDHT{
 		datastore:    dstore,
 		self:         h.ID(),
 		peerstore:    h.Peerstore(),
 		host:         h,
-		strmap:       make(map[peer.ID]*messageSender),
+		strmap:       make(map[peer.ID]*senderPool),
+		poolStats:    new(StreamPoolStats),
 		ctx:          ctx,
+		cancel:       cancel,
 		providers:    providers.NewProviderManager(ctx, h.ID(), dstore),
 		birth:        time.Now(),
 		routingTable: kb.NewRoutingTable(KValue, kb.ConvertPeerID(h.ID()), time.Minute, h.Peerstore()),
-
-		Validator: make(record.Validator),
-		Selector:  make(record.Selector),
+		rtstate:      newRTState(),
+
+		noBatchProvide: noBatchProvide,
+		probeq:         make(chan peer.ID, probeQueueSize),
+		noDHT:          noDHT,
+		dials:          newDialHistory(),
+		limiter:        newRateLimiter(DefaultRateLimitConfig),
+		handlers:       make(map[pb.Message_MessageType]MessageHandler),
+		caps:           caps,
+		peerCaps:       newCapabilitiesCache(),
+		msgLimits:      DefaultMessageLimits,
+		limitStats:     new(MessageLimitStats),
+		rtsnap:         DefaultRTSnapshotConfig,
+		rtsnapset:      make(chan struct{}, 1),
+		dsSlots:        make(chan struct{}, maxDatastoreCalls),
+		lastLookup:     make(map[int]time.Time),
+
+		Validator:  make(record.Validator),
+		Selector:   make(record.Selector),
+		addrFilter: LANAwareAddrFilter(h.Network()),
 	}
 }
 
@@ -255,7 +359,10 @@ func (dht *IpfsDHT) putLocal(key string, rec *recpb.Record) error {
 // on the given peer.
 func (dht *IpfsDHT) Update(ctx context.Context, p peer.ID) {
 	log.Event(ctx, "updatePeer", p)
-	dht.routingTable.Update(p)
+
+	dht.rtlk.Lock()
+	defer dht.rtlk.Unlock()
+	dht.updatePeer(p)
 }
 
 // FindLocal looks for a peer with a given ID connected to this dht and returns the peer and the table it was found in.
@@ -328,6 +435,9 @@ func (dht *IpfsDHT) betterPeersToQuery(pmes *pb.Message, p peer.ID, count int) [
 		if clp == p {
 			continue
 		}
+		if !dht.allowPeer(clp) {
+			continue
+		}
 
 		filtered = append(filtered, clp)
 	}
@@ -336,6 +446,11 @@ func (dht *IpfsDHT) betterPeersToQuery(pmes *pb.Message, p peer.ID, count int) [
 	return filtered
 }
 
+// ProviderManager returns the store of provider records held by this node.
+func (dht *IpfsDHT) ProviderManager() *providers.ProviderManager {
+	return dht.providers
+}
+
 // Context return dht's context
 func (dht *IpfsDHT) Context() context.Context {
 	return dht.ctx
@@ -346,8 +461,13 @@ func (dht *IpfsDHT) Process() goprocess.Process {
 	return dht.proc
 }
 
-// Close calls Process Close
+// Close stops taking on requests, waits up to ShutdownTimeout for the ones
+// in flight, then closes the process, cancelling whatever is left.
 func (dht *IpfsDHT) Close() error {
+	dht.stopAccepting()
+	if !dht.waitForWork(ShutdownTimeout) {
+		log.Warningf("%s closing with requests still in flight", dht.self)
+	}
 	return dht.proc.Close()
 }
 
@@ -6,12 +6,12 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
-	"sync"
 	"time"
 
 	u "github.com/ipfs/go-ipfs-util"
 	goprocess "github.com/jbenet/goprocess"
 	periodicproc "github.com/jbenet/goprocess/periodic"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	peer "github.com/libp2p/go-libp2p-peer"
 	routing "github.com/libp2p/go-libp2p-routing"
 )
@@ -22,8 +22,8 @@ import (
 // number of queries. We could support a higher period with less
 // queries.
 type BootstrapConfig struct {
-	Queries int           // how many queries to run per period
-	Period  time.Duration // how often to run periodi cbootstrap.
+	Queries int           // how many queries to run per stale bucket
+	Period  time.Duration // how often to run periodi cbootstrap, and how long a bucket stays fresh after a lookup.
 	Timeout time.Duration // how long to wait for a bootstrao query to run
 }
 
@@ -43,9 +43,9 @@ var DefaultBootstrapConfig = BootstrapConfig{
 }
 
 // Bootstrap ensures the dht routing table remains healthy as peers come and go.
-// it builds up a list of peers by requesting random peer IDs. The Bootstrap
-// process will run a number of queries each time, and run every time signal fires.
-// These parameters are configurable.
+// it looks up our own ID, then refreshes every bucket that has not seen a lookup
+// within the period by requesting a random peer ID in that bucket. It runs once
+// right away, and then periodically. These parameters are configurable.
 //
 // As opposed to BootstrapWithConfig, Bootstrap satisfies the routing interface
 func (dht *IpfsDHT) Bootstrap(ctx context.Context) error {
@@ -68,9 +68,9 @@ func (dht *IpfsDHT) Bootstrap(ctx context.Context) error {
 }
 
 // BootstrapWithConfig ensures the dht routing table remains healthy as peers come and go.
-// it builds up a list of peers by requesting random peer IDs. The Bootstrap
-// process will run a number of queries each time, and run every time signal fires.
-// These parameters are configurable.
+// it looks up our own ID, then refreshes every bucket that has not seen a lookup
+// within the period by requesting a random peer ID in that bucket. It runs once
+// right away, and then periodically. These parameters are configurable.
 //
 // BootstrapWithConfig returns a process, so the user can stop it.
 func (dht *IpfsDHT) BootstrapWithConfig(cfg BootstrapConfig) (goprocess.Process, error) {
@@ -79,13 +79,15 @@ func (dht *IpfsDHT) BootstrapWithConfig(cfg BootstrapConfig) (goprocess.Process,
 	}
 
 	proc := periodicproc.Tick(cfg.Period, dht.bootstrapWorker(cfg))
+	proc.Go(dht.bootstrapWorker(cfg))
 
 	return proc, nil
 }
 
 // SignalBootstrap ensures the dht routing table remains healthy as peers come and go.
-// it builds up a list of peers by requesting random peer IDs. The Bootstrap
-// process will run a number of queries each time, and run every time signal fires.
+// it looks up our own ID, then refreshes every bucket that has not seen a lookup
+// within the period by requesting a random peer ID in that bucket. The Bootstrap
+// process will run every time signal fires.
 // These parameters are configurable.
 //
 // SignalBootstrap returns a process, so the user can stop it.
@@ -116,7 +118,69 @@ func (dht *IpfsDHT) bootstrapWorker(cfg BootstrapConfig) func(worker goprocess.P
 	}
 }
 
-// runBootstrap builds up list of peers by requesting random peer IDs
+// maxRefreshCpl is the longest common prefix length we generate random
+// peer IDs for. Finding an ID with a given prefix length takes about 2^cpl
+// tries, and there are rarely enough peers to fill buckets past this one.
+const maxRefreshCpl = 15
+
+// recordLookup notes that a lookup for key has just been run, refreshing
+// the bucket key falls into.
+func (dht *IpfsDHT) recordLookup(key string) {
+	cpl := commonPrefixLen(kb.ConvertPeerID(dht.self), kb.ConvertKey(key))
+
+	dht.lookuplk.Lock()
+	dht.lastLookup[cpl] = time.Now()
+	dht.lookuplk.Unlock()
+}
+
+// staleBuckets returns the common prefix lengths of the buckets that have
+// not seen a lookup within period, up to the deepest bucket in use.
+func (dht *IpfsDHT) staleBuckets(period time.Duration) []int {
+	self := kb.ConvertPeerID(dht.self)
+	maxCpl := 0
+	for _, p := range dht.routingTable.ListPeers() {
+		if cpl := commonPrefixLen(self, kb.ConvertPeerID(p)); cpl > maxCpl {
+			maxCpl = cpl
+		}
+	}
+	if maxCpl > maxRefreshCpl {
+		maxCpl = maxRefreshCpl
+	}
+
+	now := time.Now()
+	dht.lookuplk.Lock()
+	defer dht.lookuplk.Unlock()
+
+	var stale []int
+	for cpl := 0; cpl <= maxCpl; cpl++ {
+		if now.Sub(dht.lastLookup[cpl]) >= period {
+			stale = append(stale, cpl)
+		}
+	}
+	return stale
+}
+
+// randomPeerIDWithCpl returns a random peer ID that shares exactly cpl
+// leading bits with our own ID in the keyspace, i.e. one that falls into
+// the bucket for cpl.
+func (dht *IpfsDHT) randomPeerIDWithCpl(cpl int) peer.ID {
+	self := kb.ConvertPeerID(dht.self)
+
+	// 16 random bytes is not a valid peer id. it may be fine becuase
+	// the dht will rehash to its own keyspace anyway.
+	buf := make([]byte, 16)
+	for {
+		rand.Read(buf)
+		id := peer.ID(u.Hash(buf))
+		if commonPrefixLen(self, kb.ConvertPeerID(id)) == cpl {
+			return id
+		}
+	}
+}
+
+// runBootstrap looks up our own ID, to learn about our closest peers, and
+// then refreshes every bucket that has not seen a lookup within cfg.Period
+// by looking up a random ID that falls into it.
 func (dht *IpfsDHT) runBootstrap(ctx context.Context, cfg BootstrapConfig) error {
 	bslog := func(msg string) {
 		log.Debugf("DHT %s dhtRunBootstrap %s -- routing table size: %d", dht.self, msg, dht.routingTable.Size())
@@ -127,19 +191,19 @@ func (dht *IpfsDHT) runBootstrap(ctx context.Context, cfg BootstrapConfig) error
 
 	var merr u.MultiErr
 
-	randomID := func() peer.ID {
-		// 16 random bytes is not a valid peer id. it may be fine becuase
-		// the dht will rehash to its own keyspace anyway.
-		id := make([]byte, 16)
-		rand.Read(id)
-		id = u.Hash(id)
-		return peer.ID(id)
+	// self lookup first, so the near buckets are populated before we
+	// decide which buckets need refreshing.
+	selfCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	_, err := dht.closestPeers(selfCtx, string(dht.self))
+	cancel()
+	if err != nil && err != context.DeadlineExceeded {
+		merr = append(merr, err)
 	}
 
-	// bootstrap sequentially, as results will compound
-	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
-	defer cancel()
-	runQuery := func(ctx context.Context, id peer.ID) {
+	runQuery := func(id peer.ID) {
+		ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+
 		p, err := dht.FindPeer(ctx, id)
 		if err == routing.ErrNotFound {
 			// this isn't an error. this is precisely what we expect.
@@ -154,33 +218,21 @@ func (dht *IpfsDHT) runBootstrap(ctx context.Context, cfg BootstrapConfig) error
 		}
 	}
 
-	sequential := true
-	if sequential {
-		// these should be parallel normally. but can make them sequential for debugging.
-		// note that the core/bootstrap context deadline should be extended too for that.
-		for i := 0; i < cfg.Queries; i++ {
-			id := randomID()
-			log.Debugf("Bootstrapping query (%d/%d) to random ID: %s", i+1, cfg.Queries, id)
-			runQuery(ctx, id)
+	// refresh sequentially, as results will compound
+	stale := dht.staleBuckets(cfg.Period)
+	for i, cpl := range stale {
+		select {
+		case <-ctx.Done():
+			merr = append(merr, ctx.Err())
+			return merr
+		default:
 		}
 
-	} else {
-		// note on parallelism here: the context is passed in to the queries, so they
-		// **should** exit when it exceeds, making this function exit on ctx cancel.
-		// normally, we should be selecting on ctx.Done() here too, but this gets
-		// complicated to do with WaitGroup, and doesnt wait for the children to exit.
-		var wg sync.WaitGroup
-		for i := 0; i < cfg.Queries; i++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-
-				id := randomID()
-				log.Debugf("Bootstrapping query (%d/%d) to random ID: %s", i+1, cfg.Queries, id)
-				runQuery(ctx, id)
-			}()
+		for j := 0; j < cfg.Queries; j++ {
+			id := dht.randomPeerIDWithCpl(cpl)
+			log.Debugf("Refreshing bucket %d (%d/%d) with random ID: %s", cpl, i+1, len(stale), id)
+			runQuery(id)
 		}
-		wg.Wait()
 	}
 
 	if len(merr) > 0 {
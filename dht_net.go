@@ -3,7 +3,9 @@ package dht
 import (
 	"context"
 	"fmt"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ggio "github.com/gogo/protobuf/io"
@@ -16,27 +18,76 @@ import (
 var dhtReadMessageTimeout = time.Minute
 var ErrReadTimeout = fmt.Errorf("timed out reading response")
 
+// HandlerTimeout is how long we work on an inbound request before giving up
+// on it. Requesters time out after dhtReadMessageTimeout anyway.
+var HandlerTimeout = 30 * time.Second
+
+var errHandlerTimeout = &handlerError{code: pb.Message_BUSY, msg: "timed out handling request"}
+
 // handleNewStream implements the inet.StreamHandler
 func (dht *IpfsDHT) handleNewStream(s inet.Stream) {
+	if dht.closing() {
+		s.Close()
+		return
+	}
 	go dht.handleNewMessage(s)
 }
 
 func (dht *IpfsDHT) handleNewMessage(s inet.Stream) {
 	defer s.Close()
 
-	ctx := dht.Context()
+	// handlers still running when the stream goes away are cancelled
+	ctx, cancel := context.WithCancel(dht.Context())
+	defer cancel()
+
 	cr := ctxio.NewReader(ctx, s) // ok to use. we defer close stream in this func
 	cw := ctxio.NewWriter(ctx, s) // ok to use. we defer close stream in this func
-	r := ggio.NewDelimitedReader(cr, inet.MessageSizeMax)
+	r := ggio.NewDelimitedReader(cr, dht.maxMessageSize())
 	w := ggio.NewDelimitedWriter(cw)
 	mPeer := s.Conn().RemotePeer()
 
-	for {
-		// receive msg
-		pmes := new(pb.Message)
-		if err := r.ReadMsg(pmes); err != nil {
-			log.Debugf("Error unmarshaling data: %s", err)
-			return
+	// responses to requests with IDs are written from their own goroutines
+	var wlk sync.Mutex
+	writeMsg := func(rpmes *pb.Message) error {
+		wlk.Lock()
+		defer wlk.Unlock()
+		return w.WriteMsg(rpmes)
+	}
+
+	// Messages are read ahead of the one being handled, so that a stream
+	// going away cancels the handlers still working on it.
+	msgs := make(chan *pb.Message)
+	go func() {
+		defer close(msgs)
+		for {
+			// receive msg
+			pmes := new(pb.Message)
+			if err := r.ReadMsg(pmes); err != nil {
+				if err == io.ErrShortBuffer {
+					atomic.AddUint64(&dht.limitStats.Requests, 1)
+				}
+				log.Debugf("Error unmarshaling data: %s", err)
+				cancel()
+				return
+			}
+
+			select {
+			case msgs <- pmes:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for pmes := range msgs {
+		// turn down requests over the limits before anything else
+		if err := dht.checkMessage(pmes); err != nil {
+			atomic.AddUint64(&dht.limitStats.Requests, 1)
+			log.Debugf("%s turning down %s from %s: %s", dht.self, pmes.GetType(), mPeer, err)
+			if err := dht.handleMessage(ctx, mPeer, pmes, rejectHandler(err), writeMsg); err != nil {
+				return
+			}
+			continue
 		}
 
 		// update the peer (on valid msgs only)
@@ -46,46 +97,152 @@ func (dht *IpfsDHT) handleNewMessage(s inet.Stream) {
 		handler := dht.handlerForMsgType(pmes.GetType())
 		if handler == nil {
 			log.Debug("got back nil handler from handlerForMsgType")
+			handler = unsupportedTypeHandler
+		}
+
+		// Close waits for the requests we took on, and takes on no more.
+		if !dht.startWork() {
 			return
 		}
 
-		// dispatch handler.
-		rpmes, err := handler(ctx, mPeer, pmes)
+		// turn the request down if the peer, or we, are over the limits.
+		release, err := dht.limiter.admit(mPeer, pmes.GetType())
 		if err != nil {
-			log.Debugf("handle message error: %s", err)
-			return
+			log.Debugf("%s rejecting %s from %s: %s", dht.self, pmes.GetType(), mPeer, err)
+			dht.limiter.turnedDown(pmes)
+			err = dht.handleMessage(ctx, mPeer, pmes, rejectHandler(err), writeMsg)
+			dht.doneWork()
+			if err != nil {
+				return
+			}
+			continue
+		}
+		done := func() {
+			release()
+			dht.doneWork()
 		}
 
-		// if nil response, return it before serializing
-		if rpmes == nil {
-			log.Debug("got back nil response from request")
+		// requests with IDs may be answered out of order, so handle them
+		// concurrently, and keep reading.
+		if pmes.RequestId != nil {
+			pmes := pmes
+			go func() {
+				defer done()
+				if err := dht.handleMessage(ctx, mPeer, pmes, handler, writeMsg); err != nil {
+					s.Close()
+				}
+			}()
 			continue
 		}
 
-		// send out response msg
-		if err := w.WriteMsg(rpmes); err != nil {
-			log.Debugf("send response error: %s", err)
+		// the stream going away does not stop work on messages that expect
+		// no response, their senders may hang up right after sending them.
+		hctx := ctx
+		if !expectsResponse(pmes) {
+			hctx = dht.Context()
+		}
+		err = dht.handleMessage(hctx, mPeer, pmes, handler, writeMsg)
+		done()
+		if err != nil {
 			return
 		}
 	}
 }
 
+// unsupportedTypeHandler rejects messages of a type we do not handle.
+func unsupportedTypeHandler(_ context.Context, _ peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	return nil, &handlerError{
+		code: pb.Message_UNSUPPORTED_TYPE,
+		msg:  fmt.Sprintf("unsupported message type %d", pmes.GetType()),
+	}
+}
+
+// expectsResponse reports whether the sender of pmes waits for a response,
+// and so should be told when we fail to handle it. Of the built-in types,
+// only single ADD_PROVIDER announcements are fire and forget. Registered
+// types are only answered when sent as requests, which carry an ID.
+func expectsResponse(pmes *pb.Message) bool {
+	if pmes.RequestId != nil {
+		return true
+	}
+	return builtinMessageType(pmes.GetType()) && pmes.GetType() != pb.Message_ADD_PROVIDER
+}
+
+// handleMessage runs handler on pmes and writes out the response, if any.
+// When the handler fails, the sender is sent an error response instead.
+func (dht *IpfsDHT) handleMessage(ctx context.Context, p peer.ID, pmes *pb.Message, handler dhtHandler, writeMsg func(*pb.Message) error) error {
+	ctx, cancel := context.WithTimeout(ctx, HandlerTimeout)
+	defer cancel()
+
+	// dispatch handler.
+	rpmes, err := handler(ctx, p, pmes)
+	if err != nil {
+		log.Debugf("handle message error: %s", err)
+		if !expectsResponse(pmes) {
+			return nil
+		}
+		// hang up on peers that would take the error for a response
+		if dht.peerLacksCapability(p, CapErrorResponses) {
+			return err
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			err = errHandlerTimeout
+		}
+		rpmes = errorResponse(pmes, err)
+	}
+
+	// if nil response, return it before serializing
+	if rpmes == nil {
+		log.Debug("got back nil response from request")
+		return nil
+	}
+
+	// echo the request ID, so the sender can match up the response
+	if pmes.RequestId != nil {
+		id := pmes.GetRequestId()
+		rpmes.RequestId = &id
+	}
+
+	// send out response msg
+	if err := writeMsg(rpmes); err != nil {
+		log.Debugf("send response error: %s", err)
+		return err
+	}
+	return nil
+}
+
 // sendRequest sends out a request, but also makes sure to
 // measure the RTT for latency measurements.
 func (dht *IpfsDHT) sendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
 
 	ms := dht.messageSenderForPeer(p)
+	defer dht.releaseMessageSender(ms)
 
 	start := time.Now()
 
 	rpmes, err := ms.SendRequest(ctx, pmes)
+	if err == io.ErrShortBuffer {
+		atomic.AddUint64(&dht.limitStats.Responses, 1)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if err := dht.checkResponse(p, rpmes); err != nil {
+		return nil, err
+	}
 
 	// update the peer (on valid msgs only)
 	dht.updateFromMessage(ctx, p, rpmes)
 
+	// the peer is alive, but rejected the request
+	if err := remoteError(p, rpmes); err != nil {
+		dht.peerstore.RecordLatency(p, time.Since(start))
+		return nil, err
+	}
+
+	dht.peerUseful(p)
+	dht.recordConnectionHints(p, rpmes)
+
 	dht.peerstore.RecordLatency(p, time.Since(start))
 	log.Event(ctx, "dhtReceivedMessage", dht.self, p, rpmes)
 	return rpmes, nil
@@ -95,6 +252,7 @@ func (dht *IpfsDHT) sendRequest(ctx context.Context, p peer.ID, pmes *pb.Message
 func (dht *IpfsDHT) sendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
 
 	ms := dht.messageSenderForPeer(p)
+	defer dht.releaseMessageSender(ms)
 
 	if err := ms.SendMessage(ctx, pmes); err != nil {
 		return err
@@ -108,19 +266,6 @@ func (dht *IpfsDHT) updateFromMessage(ctx context.Context, p peer.ID, mes *pb.Me
 	return nil
 }
 
-func (dht *IpfsDHT) messageSenderForPeer(p peer.ID) *messageSender {
-	dht.smlk.Lock()
-	defer dht.smlk.Unlock()
-
-	ms, ok := dht.strmap[p]
-	if !ok {
-		ms = dht.newMessageSender(p)
-		dht.strmap[p] = ms
-	}
-
-	return ms
-}
-
 type messageSender struct {
 	s   inet.Stream
 	r   ggio.ReadCloser
@@ -130,6 +275,21 @@ type messageSender struct {
 	dht *IpfsDHT
 
 	singleMes int
+	closed    bool // set once the sender left its pool, it opens no more streams
+
+	// pool bookkeeping, guarded by dht.smlk
+	inflight int
+	lastUsed time.Time
+
+	nextID uint64
+	// mux is set once a peer that advertised CapRequestIDs echoed a request
+	// ID. From then on requests are pipelined, with a reader
+	// goroutine matching up the responses, until a response comes in without
+	// an ID.
+	mux bool
+	// pending requests on the stream the reader goroutine is running for,
+	// nil if there is no reader.
+	pending map[uint64]chan *pb.Message
 }
 
 func (dht *IpfsDHT) newMessageSender(p peer.ID) *messageSender {
@@ -137,6 +297,9 @@ func (dht *IpfsDHT) newMessageSender(p peer.ID) *messageSender {
 }
 
 func (ms *messageSender) prep() error {
+	if ms.closed {
+		return errSenderClosed
+	}
 	if ms.s != nil {
 		return nil
 	}
@@ -146,13 +309,36 @@ func (ms *messageSender) prep() error {
 		return err
 	}
 
-	ms.r = ggio.NewDelimitedReader(nstr, inet.MessageSizeMax)
+	ms.r = ggio.NewDelimitedReader(nstr, ms.dht.maxMessageSize())
 	ms.w = ggio.NewDelimitedWriter(nstr)
 	ms.s = nstr
+	ms.pending = nil
 
 	return nil
 }
 
+// resetStream closes the current stream, so the next message opens a new one.
+func (ms *messageSender) resetStream() {
+	if ms.s != nil {
+		ms.s.Close()
+		atomic.AddUint64(&ms.dht.poolStats.Resets, 1)
+	}
+	ms.s = nil
+	ms.pending = nil
+}
+
+// close closes the sender's stream for good.
+func (ms *messageSender) close() {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	ms.closed = true
+	if ms.s != nil {
+		ms.s.Close()
+	}
+	ms.s = nil
+	ms.pending = nil
+}
+
 // streamReuseTries is the number of times we will try to reuse a stream to a
 // given peer before giving up and reverting to the old one-message-per-stream
 // behaviour.
@@ -170,8 +356,7 @@ func (ms *messageSender) SendMessage(ctx context.Context, pmes *pb.Message) erro
 	}
 
 	if ms.singleMes > streamReuseTries {
-		ms.s.Close()
-		ms.s = nil
+		ms.resetStream()
 	}
 
 	return nil
@@ -185,8 +370,7 @@ func (ms *messageSender) writeMessage(pmes *pb.Message) error {
 		// before continuing
 
 		log.Infof("error writing message: ", err)
-		ms.s.Close()
-		ms.s = nil
+		ms.resetStream()
 		if err := ms.prep(); err != nil {
 			return err
 		}
@@ -202,14 +386,29 @@ func (ms *messageSender) writeMessage(pmes *pb.Message) error {
 	return nil
 }
 
+// withRequestID returns a shallow copy of pmes carrying a fresh request ID,
+// so that callers may share a message between senders.
+func (ms *messageSender) withRequestID(pmes *pb.Message) (*pb.Message, uint64) {
+	ms.nextID++
+	id := ms.nextID
+	req := *pmes
+	req.RequestId = &id
+	return &req, id
+}
+
 func (ms *messageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb.Message, error) {
 	ms.lk.Lock()
+	if ms.mux {
+		return ms.sendRequestMux(ctx, pmes)
+	}
 	defer ms.lk.Unlock()
+
 	if err := ms.prep(); err != nil {
 		return nil, err
 	}
 
-	if err := ms.writeMessage(pmes); err != nil {
+	req, id := ms.withRequestID(pmes)
+	if err := ms.writeMessage(req); err != nil {
 		return nil, err
 	}
 
@@ -217,19 +416,131 @@ func (ms *messageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb
 
 	mes := new(pb.Message)
 	if err := ms.ctxReadMsg(ctx, mes); err != nil {
-		ms.s.Close()
-		ms.s = nil
+		ms.resetStream()
 		return nil, err
 	}
 
+	// the peer supports request IDs and echoes ours, so we can pipeline
+	// further requests. Older nodes echo some requests whole (PING and
+	// PUT_VALUE), ID included, so an echo only counts if the peer advertised
+	// the capability.
+	if mes.RequestId != nil && mes.GetRequestId() == id &&
+		ms.dht.peerHasCapability(ms.p, CapRequestIDs) {
+		ms.mux = true
+	}
+
 	if ms.singleMes > streamReuseTries {
-		ms.s.Close()
-		ms.s = nil
+		ms.resetStream()
 	}
 
 	return mes, nil
 }
 
+// sendRequestMux sends a request without waiting for earlier ones to be
+// answered. It must be called with ms.lk held, and releases it.
+func (ms *messageSender) sendRequestMux(ctx context.Context, pmes *pb.Message) (*pb.Message, error) {
+	if err := ms.prep(); err != nil {
+		ms.lk.Unlock()
+		return nil, err
+	}
+
+	if ms.pending == nil {
+		ms.pending = make(map[uint64]chan *pb.Message)
+		go ms.readLoop(ms.s, ms.r, ms.pending)
+	}
+	pending := ms.pending
+
+	req, id := ms.withRequestID(pmes)
+	resp := make(chan *pb.Message, 1)
+	pending[id] = resp
+
+	if err := ms.w.WriteMsg(req); err != nil {
+		ms.resetStream()
+		ms.lk.Unlock()
+		return nil, err
+	}
+	ms.lk.Unlock()
+
+	log.Event(ctx, "dhtSentMessage", ms.dht.self, ms.p, pmes)
+
+	t := time.NewTimer(dhtReadMessageTimeout)
+	defer t.Stop()
+
+	var err error
+	select {
+	case mes, ok := <-resp:
+		if !ok {
+			// the stream failed before the response came in
+			return nil, io.EOF
+		}
+		return mes, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-t.C:
+		err = ErrReadTimeout
+	}
+
+	// a late response will be dropped by the reader
+	ms.lk.Lock()
+	delete(pending, id)
+	ms.lk.Unlock()
+	return nil, err
+}
+
+// readLoop hands the responses read from s to the requests waiting for them,
+// until s fails. The pending requests are then failed, and s is reset. A
+// response without a request ID means the peer does not support them after
+// all: it goes to the only pending request, if there is just one, and the
+// sender falls back to sending requests one at a time.
+func (ms *messageSender) readLoop(s inet.Stream, r ggio.ReadCloser, pending map[uint64]chan *pb.Message) {
+	var noID *pb.Message
+	for {
+		mes := new(pb.Message)
+		if err := r.ReadMsg(mes); err != nil {
+			if err == io.ErrShortBuffer {
+				atomic.AddUint64(&ms.dht.limitStats.Responses, 1)
+			}
+			log.Debugf("error reading from %s: %s", ms.p, err)
+			break
+		}
+		if mes.RequestId == nil {
+			log.Debugf("response without request id from %s, no longer pipelining", ms.p)
+			noID = mes
+			break
+		}
+
+		ms.lk.Lock()
+		resp, ok := pending[mes.GetRequestId()]
+		delete(pending, mes.GetRequestId())
+		ms.lk.Unlock()
+
+		if ok {
+			resp <- mes
+		}
+	}
+
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	if noID != nil {
+		ms.mux = false
+		if len(pending) == 1 {
+			for id, resp := range pending {
+				delete(pending, id)
+				resp <- noID
+			}
+		}
+	}
+	for id, resp := range pending {
+		delete(pending, id)
+		close(resp)
+	}
+	if ms.s == s {
+		ms.resetStream()
+	} else {
+		s.Close()
+	}
+}
+
 func (ms *messageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) error {
 	errc := make(chan error, 1)
 	go func(r ggio.ReadCloser) {
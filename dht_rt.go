@@ -0,0 +1,315 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ReplacementCacheSize is the number of peers remembered per bucket to take
+// the place of peers that stop responding.
+var ReplacementCacheSize = 8
+
+// EvictionPingTimeout is how long the least recently seen peer of a full
+// bucket has to answer a ping before it is evicted.
+var EvictionPingTimeout = 10 * time.Second
+
+// peers seen more recently than this are not pinged when their bucket is full
+const evictionPingGrace = time.Minute
+
+type rtPeerInfo struct {
+	cpl        int       // common prefix length with our own ID
+	added      time.Time // when the peer entered the routing table
+	lastSeen   time.Time // last time we heard from the peer
+	lastUseful time.Time // last time the peer answered one of our requests
+	prefixes   []string  // public network prefixes of the peer's addresses
+}
+
+// rtState mirrors the routing table, so we know a bucket is full before
+// kbucket would silently drop a peer from it. It is guarded by dht.rtlk.
+type rtState struct {
+	peers        map[peer.ID]*rtPeerInfo
+	nBuckets     int
+	replacements map[int][]peer.ID // by common prefix length, most recent last
+	pinging      map[peer.ID]bool
+
+	diversity DiversityConfig
+	rejected  []DiversityRejection // most recent last
+
+	subs map[chan RoutingTableEvent]struct{}
+}
+
+func newRTState() *rtState {
+	return &rtState{
+		peers:        make(map[peer.ID]*rtPeerInfo),
+		nBuckets:     1,
+		replacements: make(map[int][]peer.ID),
+		pinging:      make(map[peer.ID]bool),
+		diversity:    DefaultDiversityConfig,
+		subs:         make(map[chan RoutingTableEvent]struct{}),
+	}
+}
+
+// bucketFor returns the index of the bucket holding peers with the given
+// common prefix length.
+func (st *rtState) bucketFor(cpl int) int {
+	if cpl >= st.nBuckets-1 {
+		return st.nBuckets - 1
+	}
+	return cpl
+}
+
+// bucketsAfterAdd returns the number of buckets the routing table will have
+// once a peer with the given common prefix length is added to it, or -1 if
+// adding it would make the routing table drop another peer.
+func (st *rtState) bucketsAfterAdd(cpl int) int {
+	last := st.nBuckets - 1
+	b := st.bucketFor(cpl)
+
+	var cpls []int
+	for _, pi := range st.peers {
+		if st.bucketFor(pi.cpl) == b {
+			cpls = append(cpls, pi.cpl)
+		}
+	}
+	cpls = append(cpls, cpl)
+
+	if b < last {
+		if len(cpls) > KValue {
+			return -1
+		}
+		return st.nBuckets
+	}
+
+	// The last bucket is split for as long as it overflows. A peer is only
+	// dropped when too many peers are left behind in the bucket being split.
+	for l := last; ; l++ {
+		deeper, here := 0, 0
+		for _, c := range cpls {
+			if c >= l {
+				deeper++
+			}
+			if c == l {
+				here++
+			}
+		}
+		if deeper <= KValue {
+			return l + 1
+		}
+		if here > KValue {
+			return -1
+		}
+	}
+}
+
+func (st *rtState) addReplacement(p peer.ID, cpl int) {
+	st.removeReplacement(p, cpl)
+	reps := append(st.replacements[cpl], p)
+	if len(reps) > ReplacementCacheSize {
+		reps = reps[len(reps)-ReplacementCacheSize:]
+	}
+	st.replacements[cpl] = reps
+}
+
+func (st *rtState) removeReplacement(p peer.ID, cpl int) {
+	reps := st.replacements[cpl]
+	for i, r := range reps {
+		if r == p {
+			reps = append(reps[:i:i], reps[i+1:]...)
+			break
+		}
+	}
+	if len(reps) == 0 {
+		delete(st.replacements, cpl)
+	} else {
+		st.replacements[cpl] = reps
+	}
+}
+
+// popReplacement removes and returns the most recently seen replacement that
+// fits into bucket b, or "" if there is none.
+func (st *rtState) popReplacement(b int) peer.ID {
+	for cpl, reps := range st.replacements {
+		if st.bucketFor(cpl) != b || st.bucketsAfterAdd(cpl) < 0 {
+			continue
+		}
+		p := reps[len(reps)-1]
+		st.removeReplacement(p, cpl)
+		return p
+	}
+	return ""
+}
+
+// updatePeer adds p to the routing table, or marks it as seen if it is
+// already there. If p's bucket is full, p goes to the bucket's replacement
+// cache and the least recently seen peer in the bucket is checked for
+// liveness. It must be called with dht.rtlk held.
+func (dht *IpfsDHT) updatePeer(p peer.ID) bool {
+	st := dht.rtstate
+	now := time.Now()
+
+	if !dht.allowPeer(p) {
+		dht.removePeerLocked(p, PeerRemoved)
+		return false
+	}
+
+	if pi, ok := st.peers[p]; ok {
+		pi.lastSeen = now
+		dht.routingTable.Update(p) // move it to the front of its bucket
+		return true
+	}
+
+	cpl := commonPrefixLen(kb.ConvertPeerID(dht.self), kb.ConvertPeerID(p))
+	prefixes := addrPrefixes(dht.peerstore.Addrs(p))
+	if !st.checkDiversity(p, cpl, prefixes) {
+		return false
+	}
+
+	n := st.bucketsAfterAdd(cpl)
+	if n < 0 {
+		st.addReplacement(p, cpl)
+		dht.checkBucketLocked(st.bucketFor(cpl))
+		return false
+	}
+
+	dht.routingTable.Update(p)
+	if dht.routingTable.Find(p) == "" {
+		// kbucket turned the peer down, e.g. because of its latency
+		return false
+	}
+
+	for ; st.nBuckets < n; st.nBuckets++ {
+		st.publish(RoutingTableEvent{Type: BucketSplit, Bucket: st.nBuckets - 1})
+	}
+	st.peers[p] = &rtPeerInfo{
+		cpl:      cpl,
+		added:    now,
+		lastSeen: now,
+		prefixes: prefixes,
+	}
+	st.removeReplacement(p, cpl)
+	st.publish(RoutingTableEvent{Type: PeerAdded, Peer: p, Bucket: st.bucketFor(cpl)})
+	return true
+}
+
+// checkBucketLocked pings the least recently seen peer of bucket b, unless it
+// was seen recently, so it can be replaced if it does not answer.
+func (dht *IpfsDHT) checkBucketLocked(b int) {
+	st := dht.rtstate
+
+	var lrs peer.ID
+	var lrsInfo *rtPeerInfo
+	for p, pi := range st.peers {
+		if st.bucketFor(pi.cpl) != b {
+			continue
+		}
+		if lrsInfo == nil || pi.lastSeen.Before(lrsInfo.lastSeen) {
+			lrs, lrsInfo = p, pi
+		}
+	}
+
+	if lrsInfo == nil || time.Since(lrsInfo.lastSeen) < evictionPingGrace || st.pinging[lrs] {
+		return
+	}
+
+	dht.startEvictionPingLocked(lrs)
+}
+
+// startEvictionPingLocked pings p in the background, and evicts it if it
+// does not answer. It must be called with dht.rtlk held.
+func (dht *IpfsDHT) startEvictionPingLocked(p peer.ID) {
+	st := dht.rtstate
+	st.pinging[p] = true
+	if !dht.goTracked(func() { dht.pingForEviction(p) }) {
+		delete(st.pinging, p)
+	}
+}
+
+func (dht *IpfsDHT) pingForEviction(p peer.ID) {
+	ctx, cancel := context.WithTimeout(dht.Context(), EvictionPingTimeout)
+	defer cancel()
+
+	// a successful ping marks p as seen through updateFromMessage
+	err := dht.ping(ctx, p)
+
+	dht.rtlk.Lock()
+	defer dht.rtlk.Unlock()
+
+	delete(dht.rtstate.pinging, p)
+	switch {
+	case err == nil:
+	case dht.Context().Err() != nil || dht.closing():
+		// we are shutting down, the ping failing says nothing about p
+	default:
+		log.Debugf("evicting unresponsive peer %s: %s", p, err)
+		dht.removePeerLocked(p, PeerEvicted)
+	}
+}
+
+// removePeerLocked removes p from the routing table, reporting it to
+// subscribers as ev, and fills the gap with a peer from the replacement
+// cache. It must be called with dht.rtlk held.
+func (dht *IpfsDHT) removePeerLocked(p peer.ID, ev RoutingTableEventType) {
+	st := dht.rtstate
+	pi, ok := st.peers[p]
+	if !ok {
+		return
+	}
+
+	dht.routingTable.Remove(p)
+	delete(st.peers, p)
+
+	b := st.bucketFor(pi.cpl)
+	st.publish(RoutingTableEvent{Type: ev, Peer: p, Bucket: b})
+	for {
+		r := st.popReplacement(b)
+		if r == "" {
+			return
+		}
+		if dht.updatePeer(r) {
+			log.Debugf("replaced %s with %s in the routing table", p, r)
+			return
+		}
+	}
+}
+
+// peerUseful is called when p answered one of our requests.
+func (dht *IpfsDHT) peerUseful(p peer.ID) {
+	dht.rtlk.Lock()
+	defer dht.rtlk.Unlock()
+	if pi, ok := dht.rtstate.peers[p]; ok {
+		pi.lastUseful = time.Now()
+	}
+}
+
+// peerUnreachable is called when we failed to dial p. A single failed dial
+// may be our own network's fault, so p is pinged, regardless of when it was
+// last seen, and only evicted if that fails too.
+func (dht *IpfsDHT) peerUnreachable(p peer.ID) {
+	dht.rtlk.Lock()
+	defer dht.rtlk.Unlock()
+
+	st := dht.rtstate
+	if _, ok := st.peers[p]; !ok || st.pinging[p] {
+		return
+	}
+	dht.startEvictionPingLocked(p)
+}
+
+// ping sends a PING message to p and waits for the reply.
+func (dht *IpfsDHT) ping(ctx context.Context, p peer.ID) error {
+	pmes := pb.NewMessage(pb.Message_PING, "", 0)
+	resp, err := dht.sendRequest(ctx, p, pmes)
+	if err != nil {
+		return err
+	}
+	if resp.GetType() != pb.Message_PING {
+		return fmt.Errorf("got unexpected response type: %v", resp.GetType())
+	}
+	dht.learnCapabilities(p, resp.GetCapabilities())
+	return nil
+}
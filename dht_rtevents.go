@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"fmt"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// RoutingTableEventType is the kind of change a RoutingTableEvent reports.
+type RoutingTableEventType int
+
+const (
+	// PeerAdded is sent when a peer enters the routing table.
+	PeerAdded RoutingTableEventType = iota
+	// PeerRemoved is sent when a peer is taken out of the routing table,
+	// e.g. because the PeerFilter no longer lets it through.
+	PeerRemoved
+	// PeerEvicted is sent when a peer is taken out of the routing table
+	// because it stopped responding.
+	PeerEvicted
+	// BucketSplit is sent when the last bucket is split in two.
+	BucketSplit
+)
+
+func (t RoutingTableEventType) String() string {
+	switch t {
+	case PeerAdded:
+		return "PeerAdded"
+	case PeerRemoved:
+		return "PeerRemoved"
+	case PeerEvicted:
+		return "PeerEvicted"
+	case BucketSplit:
+		return "BucketSplit"
+	default:
+		return fmt.Sprintf("RoutingTableEventType(%d)", int(t))
+	}
+}
+
+// RoutingTableEvent describes a change to the routing table.
+type RoutingTableEvent struct {
+	Type   RoutingTableEventType
+	Peer   peer.ID // the peer added or removed, empty for BucketSplit
+	Bucket int     // the bucket the peer is in, or the bucket that was split
+}
+
+// SubscribeRoutingTable returns a channel that receives routing table events,
+// and a function that ends the subscription and closes the channel. Up to buf
+// events are buffered; events that do not fit are dropped rather than
+// holding up the routing table.
+func (dht *IpfsDHT) SubscribeRoutingTable(buf int) (<-chan RoutingTableEvent, func()) {
+	ch := make(chan RoutingTableEvent, buf)
+
+	dht.rtlk.Lock()
+	dht.rtstate.subs[ch] = struct{}{}
+	dht.rtlk.Unlock()
+
+	cancel := func() {
+		dht.rtlk.Lock()
+		defer dht.rtlk.Unlock()
+		if _, ok := dht.rtstate.subs[ch]; ok {
+			delete(dht.rtstate.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// publish sends ev to all subscribers. It must be called with dht.rtlk held.
+func (st *rtState) publish(ev RoutingTableEvent) {
+	for ch := range st.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Debugf("routing table subscriber is full, dropping %s event", ev.Type)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	goprocess "github.com/jbenet/goprocess"
+	goprocessctx "github.com/jbenet/goprocess/context"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// RTSnapshotConfig specifies how the routing table is persisted to the
+// datastore, and how it is used to seed the table on startup.
+type RTSnapshotConfig struct {
+	Period    time.Duration // how often to save the routing table, 0 disables periodic saves
+	MaxAge    time.Duration // saved peers older than this are dropped, 0 keeps them while there is room
+	SeedPeers int           // how many saved peers to reconnect to on startup, 0 disables seeding
+	Timeout   time.Duration // how long to wait for the seed connections
+}
+
+// DefaultRTSnapshotConfig is read when a DHT is constructed.
+var DefaultRTSnapshotConfig = RTSnapshotConfig{
+	Period:    10 * time.Minute,
+	MaxAge:    24 * time.Hour,
+	SeedPeers: 20,
+	Timeout:   10 * time.Second,
+}
+
+// rtSnapshotMaxPeers is the number of peers a snapshot holds at most. Peers
+// seen in the routing table most recently are kept.
+var rtSnapshotMaxPeers = 1024
+
+var rtSnapshotKey = ds.NewKey("/routing-table")
+
+// rtSnapshotPeer is the persisted form of a routing table entry.
+type rtSnapshotPeer struct {
+	ID    string
+	Addrs []string
+	Saved time.Time // last time the peer was seen in our routing table
+}
+
+type rtSnapshotEntry struct {
+	pstore.PeerInfo
+	saved time.Time
+}
+
+type bySaved []rtSnapshotEntry
+
+func (es bySaved) Len() int           { return len(es) }
+func (es bySaved) Swap(i, j int)      { es[i], es[j] = es[j], es[i] }
+func (es bySaved) Less(i, j int) bool { return es[i].saved.After(es[j].saved) }
+
+// SetRTSnapshotConfig changes how the routing table is persisted. The table
+// is seeded from the snapshot only once: if seeding was disabled when the dht
+// was constructed, a config with SeedPeers set starts it, otherwise SeedPeers
+// and Timeout have no further effect.
+func (dht *IpfsDHT) SetRTSnapshotConfig(cfg RTSnapshotConfig) {
+	dht.rtsnaplk.Lock()
+	dht.rtsnap = cfg
+	dht.rtsnaplk.Unlock()
+
+	dht.maybeSeedRoutingTable()
+	select {
+	case dht.rtsnapset <- struct{}{}:
+	default:
+	}
+}
+
+func (dht *IpfsDHT) rtSnapshotConfig() RTSnapshotConfig {
+	dht.rtsnaplk.Lock()
+	defer dht.rtsnaplk.Unlock()
+	return dht.rtsnap
+}
+
+// startRTSnapshots seeds the routing table from the last snapshot and keeps
+// the snapshot up to date for as long as the dht runs.
+func (dht *IpfsDHT) startRTSnapshots() {
+	dht.maybeSeedRoutingTable()
+	dht.proc.Go(dht.rtSnapshotLoop)
+}
+
+// maybeSeedRoutingTable starts seeding the routing table, unless it is
+// disabled or was started before.
+func (dht *IpfsDHT) maybeSeedRoutingTable() {
+	dht.rtsnaplk.Lock()
+	defer dht.rtsnaplk.Unlock()
+	if dht.rtseeded || dht.rtsnap.SeedPeers <= 0 {
+		return
+	}
+	dht.rtseeded = true
+	dht.proc.Go(dht.seedRoutingTable)
+}
+
+// rtSnapshotLoop saves the routing table every period, picking up changes to
+// the period as they are made.
+func (dht *IpfsDHT) rtSnapshotLoop(proc goprocess.Process) {
+	for {
+		var tick <-chan time.Time
+		if period := dht.rtSnapshotConfig().Period; period > 0 {
+			tick = time.After(period)
+		}
+
+		select {
+		case <-tick:
+			if err := dht.saveRoutingTable(); err != nil {
+				log.Warningf("saving routing table: %s", err)
+			}
+		case <-dht.rtsnapset:
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+// saveRoutingTable writes the peers currently in the routing table, together
+// with their addresses, to the datastore. Peers from the previous snapshot that
+// are no longer in the table are kept until they exceed the maximum age, or
+// until newer peers take their room.
+func (dht *IpfsDHT) saveRoutingTable() error {
+	now := time.Now()
+
+	entries := make(map[peer.ID]rtSnapshotEntry)
+	old, err := dht.loadRoutingTable()
+	if err != nil {
+		log.Debugf("discarding previous routing table snapshot: %s", err)
+	}
+	for _, e := range old {
+		entries[e.ID] = e
+	}
+	for _, p := range dht.routingTable.ListPeers() {
+		addrs := dht.peerstore.Addrs(p)
+		if len(addrs) == 0 {
+			if e, ok := entries[p]; ok {
+				addrs = e.Addrs
+			}
+		}
+		entries[p] = rtSnapshotEntry{
+			PeerInfo: pstore.PeerInfo{ID: p, Addrs: addrs},
+			saved:    now,
+		}
+	}
+
+	sorted := make([]rtSnapshotEntry, 0, len(entries))
+	for _, e := range entries {
+		if len(e.Addrs) == 0 {
+			continue
+		}
+		sorted = append(sorted, e)
+	}
+	sort.Sort(bySaved(sorted))
+	if len(sorted) > rtSnapshotMaxPeers {
+		sorted = sorted[:rtSnapshotMaxPeers]
+	}
+
+	snap := make([]rtSnapshotPeer, 0, len(sorted))
+	for _, e := range sorted {
+		sp := rtSnapshotPeer{
+			ID:    peer.IDB58Encode(e.ID),
+			Saved: e.saved,
+		}
+		for _, a := range e.Addrs {
+			sp.Addrs = append(sp.Addrs, a.String())
+		}
+		snap = append(snap, sp)
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return dht.datastore.Put(rtSnapshotKey, data)
+}
+
+// loadRoutingTable reads the last routing table snapshot, skipping entries
+// for ourselves and entries older than the configured maximum age.
+func (dht *IpfsDHT) loadRoutingTable() ([]rtSnapshotEntry, error) {
+	v, err := dht.datastore.Get(rtSnapshotKey)
+	if err == ds.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, errors.New("routing table snapshot stored in datastore not []byte")
+	}
+
+	var snap []rtSnapshotPeer
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+
+	maxAge := dht.rtSnapshotConfig().MaxAge
+	now := time.Now()
+	var out []rtSnapshotEntry
+	for _, sp := range snap {
+		if maxAge > 0 && now.Sub(sp.Saved) > maxAge {
+			continue
+		}
+
+		p, err := peer.IDB58Decode(sp.ID)
+		if err != nil {
+			log.Debugf("invalid peer in routing table snapshot: %s", err)
+			continue
+		}
+		if p == dht.self {
+			continue
+		}
+
+		var addrs []ma.Multiaddr
+		for _, s := range sp.Addrs {
+			a, err := ma.NewMultiaddr(s)
+			if err != nil {
+				log.Debugf("invalid address in routing table snapshot: %s", err)
+				continue
+			}
+			addrs = append(addrs, a)
+		}
+		if len(addrs) == 0 {
+			continue
+		}
+
+		out = append(out, rtSnapshotEntry{
+			PeerInfo: pstore.PeerInfo{ID: p, Addrs: addrs},
+			saved:    sp.Saved,
+		})
+	}
+	return out, nil
+}
+
+// seedRoutingTable reconnects to a random sample of the peers from the last
+// snapshot and adds the ones that answer to the routing table.
+func (dht *IpfsDHT) seedRoutingTable(proc goprocess.Process) {
+	saved, err := dht.loadRoutingTable()
+	if err != nil {
+		log.Warningf("loading routing table: %s", err)
+		return
+	}
+	if len(saved) == 0 {
+		return
+	}
+
+	cfg := dht.rtSnapshotConfig()
+	n := cfg.SeedPeers
+	if n > len(saved) {
+		n = len(saved)
+	}
+
+	ctx := goprocessctx.OnClosingContext(proc)
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	log.Debugf("seeding routing table with %d of %d saved peers", n, len(saved))
+	var wg sync.WaitGroup
+	for _, i := range rand.Perm(len(saved))[:n] {
+		pi := saved[i].PeerInfo
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			dht.peerstore.AddAddrs(pi.ID, pi.Addrs, pstore.TempAddrTTL)
+			if err := dht.host.Connect(ctx, pi); err != nil {
+				log.Debugf("seeding routing table: could not connect to %s: %s", pi.ID, err)
+				return
+			}
+			dht.dials.dialSucceeded(pi.ID)
+			dht.Update(ctx, pi.ID)
+		}()
+	}
+	wg.Wait()
+}
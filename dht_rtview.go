@@ -0,0 +1,122 @@
+package dht
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// RoutingTableSnapshot is a point in time copy of the routing table.
+type RoutingTableSnapshot struct {
+	Self peer.ID
+	Time time.Time
+	// Buckets[i] holds the peers sharing i leading bits with us, the last
+	// bucket also holds all peers sharing more.
+	Buckets []BucketSnapshot
+}
+
+// BucketSnapshot lists the peers of a bucket, most recently seen first.
+type BucketSnapshot struct {
+	Peers []PeerSnapshot
+}
+
+// PeerSnapshot describes a peer in the routing table.
+type PeerSnapshot struct {
+	ID         peer.ID
+	Addrs      []ma.Multiaddr
+	Latency    time.Duration // from the peerstore
+	Added      time.Time     // when the peer entered the routing table
+	LastUseful time.Time     // last time it answered one of our requests, zero if never
+
+	lastSeen time.Time
+}
+
+// RoutingTableSnapshot returns a copy of the routing table.
+func (dht *IpfsDHT) RoutingTableSnapshot() *RoutingTableSnapshot {
+	dht.rtlk.Lock()
+	st := dht.rtstate
+	snap := &RoutingTableSnapshot{
+		Self:    dht.self,
+		Time:    time.Now(),
+		Buckets: make([]BucketSnapshot, st.nBuckets),
+	}
+	for p, pi := range st.peers {
+		b := &snap.Buckets[st.bucketFor(pi.cpl)]
+		b.Peers = append(b.Peers, PeerSnapshot{
+			ID:         p,
+			Added:      pi.added,
+			LastUseful: pi.lastUseful,
+			lastSeen:   pi.lastSeen,
+		})
+	}
+	dht.rtlk.Unlock()
+
+	// fill in the peerstore details without holding the routing table lock
+	for i := range snap.Buckets {
+		peers := snap.Buckets[i].Peers
+		for j := range peers {
+			peers[j].Addrs = dht.peerstore.Addrs(peers[j].ID)
+			peers[j].Latency = dht.peerstore.LatencyEWMA(peers[j].ID)
+		}
+		sort.Sort(byLastSeen(peers))
+	}
+	return snap
+}
+
+// Size returns the number of peers in the snapshot.
+func (s *RoutingTableSnapshot) Size() int {
+	n := 0
+	for _, b := range s.Buckets {
+		n += len(b.Peers)
+	}
+	return n
+}
+
+type byLastSeen []PeerSnapshot
+
+func (ps byLastSeen) Len() int           { return len(ps) }
+func (ps byLastSeen) Swap(i, j int)      { ps[i], ps[j] = ps[j], ps[i] }
+func (ps byLastSeen) Less(i, j int) bool { return ps[i].lastSeen.After(ps[j].lastSeen) }
+
+// MarshalJSON encodes the snapshot with peer IDs and addresses in their
+// string forms.
+func (s *RoutingTableSnapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Self    string
+		Time    time.Time
+		Buckets []BucketSnapshot
+	}{
+		Self:    peer.IDB58Encode(s.Self),
+		Time:    s.Time,
+		Buckets: s.Buckets,
+	})
+}
+
+// MarshalJSON encodes the peer with its ID and addresses in their string
+// forms, and its latency in nanoseconds.
+func (ps PeerSnapshot) MarshalJSON() ([]byte, error) {
+	addrs := make([]string, len(ps.Addrs))
+	for i, a := range ps.Addrs {
+		addrs[i] = a.String()
+	}
+
+	out := struct {
+		ID         string
+		Addrs      []string
+		Latency    time.Duration
+		Added      time.Time
+		LastUseful *time.Time `json:",omitempty"`
+	}{
+		ID:      peer.IDB58Encode(ps.ID),
+		Addrs:   addrs,
+		Latency: ps.Latency,
+		Added:   ps.Added,
+	}
+	if !ps.LastUseful.IsZero() {
+		out.LastUseful = &ps.LastUseful
+	}
+	return json.Marshal(out)
+}
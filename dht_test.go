@@ -2,9 +2,11 @@ package dht
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -20,6 +22,7 @@ import (
 	peer "github.com/libp2p/go-libp2p-peer"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
 	record "github.com/libp2p/go-libp2p-record"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
 	ci "github.com/libp2p/go-testutil/ci"
 	travisci "github.com/libp2p/go-testutil/ci/travis"
@@ -131,6 +134,7 @@ func bootstrap(t *testing.T, ctx context.Context, dhts []*IpfsDHT) {
 	var cfg BootstrapConfig
 	cfg = DefaultBootstrapConfig
 	cfg.Queries = 3
+	cfg.Period = 0 // refresh every bucket on every run
 
 	start := rand.Intn(len(dhts)) // randomize to decrease bias.
 	for i := range dhts {
@@ -247,135 +251,1434 @@ func TestProvides(t *testing.T) {
 	}
 }
 
+func TestProviderInfos(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 3, t)
+	defer func() {
+		for i := 0; i < 3; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+
+	k := testCaseCids[0]
+	if err := dhts[2].Provide(ctx, k, true); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 10)
+
+	// forget the provider's addresses, they must come with the record.
+	dhts[1].peerstore.ClearAddrs(dhts[2].self)
+
+	ctxT, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	select {
+	case prov := <-dhts[0].FindProviderInfosAsync(ctxT, k, 1):
+		if prov.ID != dhts[2].self {
+			t.Fatal("Got back wrong provider")
+		}
+		if len(prov.Addrs) == 0 {
+			t.Fatal("provider returned without addresses")
+		}
+		if prov.Expires.Before(time.Now()) {
+			t.Fatal("expected the record's validity to be returned")
+		}
+	case <-ctxT.Done():
+		t.Fatal("Did not get a provider back.")
+	}
+}
+
+func TestProvideManyLookups(t *testing.T) {
+	ctx := context.Background()
+
+	var network []peer.ID
+	for i := 0; i < 10*KValue; i++ {
+		network = append(network, peer.ID(fmt.Sprintf("peer %d", i)))
+	}
+
+	var pkeys []provideKey
+	for i := 0; i < 1000; i++ {
+		c := cid.NewCidV0(u.Hash([]byte(fmt.Sprintf("key %d", i))))
+		pkeys = append(pkeys, provideKey{c: c, id: kb.ConvertKey(c.KeyString())})
+	}
+	sort.Sort(byKeyspace(pkeys))
+
+	// a converged lookup finds the KValue closest peers
+	lookups := 0
+	lookup := func(_ context.Context, key string) ([]peer.ID, error) {
+		lookups++
+		return kb.SortClosestPeers(network, kb.ConvertKey(key))[:KValue], nil
+	}
+
+	sent := make(map[string]int)
+	send := func(pending map[peer.ID][]*cid.Cid) {
+		for _, keys := range pending {
+			for _, c := range keys {
+				sent[c.KeyString()]++
+			}
+		}
+	}
+
+	if err := planProvides(ctx, pkeys, lookup, send); err != nil {
+		t.Fatal(err)
+	}
+
+	if lookups >= len(pkeys)/4 {
+		t.Fatalf("expected lookups to be reused, ran %d for %d keys", lookups, len(pkeys))
+	}
+	for _, k := range pkeys {
+		if n := sent[k.c.KeyString()]; n != KValue {
+			t.Fatalf("expected %s to go to %d peers, went to %d", k.c, KValue, n)
+		}
+	}
+}
+
+func TestProvideMany(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 4, t)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[1], dhts[3])
+
+	if err := dhts[3].ProvideMany(ctx, testCaseCids); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for _, c := range testCaseCids {
+		n = (n + 1) % 3
+
+		ctxT, cancel := context.WithTimeout(ctx, time.Second)
+		select {
+		case prov := <-dhts[n].FindProvidersAsync(ctxT, c, 1):
+			if prov.ID != dhts[3].self {
+				t.Fatal("Got back wrong provider")
+			}
+		case <-ctxT.Done():
+			t.Fatal("Did not get a provider back.")
+		}
+		cancel()
+	}
+}
+
 func TestLocalProvides(t *testing.T) {
 	// t.Skip("skipping test to debug another")
 	ctx := context.Background()
 
-	_, _, dhts := setupDHTS(ctx, 4, t)
+	_, _, dhts := setupDHTS(ctx, 4, t)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[1], dhts[3])
+
+	for _, k := range testCaseCids {
+		log.Debugf("announcing provider for %s", k)
+		if err := dhts[3].Provide(ctx, k, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 10)
+
+	for _, c := range testCaseCids {
+		for i := 0; i < 3; i++ {
+			provs := dhts[i].providers.GetProviders(ctx, c)
+			if len(provs) > 0 {
+				t.Fatal("shouldnt know this")
+			}
+		}
+	}
+}
+
+func TestStopProviding(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+
+	k := testCaseCids[0]
+	if err := dhts[1].Provide(ctx, k, false); err != nil {
+		t.Fatal(err)
+	}
+	if provs := dhts[1].providers.GetProviders(ctx, k); len(provs) != 1 {
+		t.Fatal("expected to provide the key locally")
+	}
+
+	if err := dhts[1].StopProviding(ctx, k); err != nil {
+		t.Fatal(err)
+	}
+	if provs := dhts[1].providers.GetProviders(ctx, k); len(provs) != 0 {
+		t.Fatal("still providing after StopProviding: ", provs)
+	}
+
+	ctxT, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	for prov := range dhts[0].FindProvidersAsync(ctxT, k, 1) {
+		t.Fatal("got a provider after StopProviding: ", prov.ID)
+	}
+}
+
+func TestProviderNegativeCache(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+
+	if err := dhts[0].EnableProviderNegativeCache(time.Minute, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	k := testCaseCids[0]
+	find := func() int {
+		ctxT, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		n := 0
+		for range dhts[0].FindProvidersAsync(ctxT, k, 1) {
+			n++
+		}
+		return n
+	}
+
+	if n := find(); n != 0 {
+		t.Fatal("expected no providers, got ", n)
+	}
+	if n := find(); n != 0 {
+		t.Fatal("expected no providers, got ", n)
+	}
+	stats := dhts[0].ProviderNegativeCacheStats()
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("expected 1 hit and 1 miss, got %+v", stats)
+	}
+
+	// providing the key ourselves must invalidate the entry
+	if err := dhts[0].Provide(ctx, k, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := find(); n != 1 {
+		t.Fatal("expected to find ourselves as provider, got ", n)
+	}
+
+	dhts[0].DisableProviderNegativeCache()
+	if stats := dhts[0].ProviderNegativeCacheStats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Fatal("expected zero stats when disabled, got ", stats)
+	}
+}
+
+func TestRoutingTableSnapshot(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 3, t)
+	defer func() {
+		for i := 0; i < 3; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+
+	// Close saves the routing table to the datastore
+	if err := dhts[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range dhts[1:] {
+		dhts[0].host.Network().ClosePeer(d.self)
+		dhts[0].peerstore.ClearAddrs(d.self)
+	}
+
+	// a restarted dht on the same datastore reconnects to the saved peers
+	d := NewDHT(ctx, dhts[0].host, dhts[0].datastore.(ds.Batching))
+	defer d.Close()
+
+	ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	for d.routingTable.Find(dhts[1].self) == "" || d.routingTable.Find(dhts[2].self) == "" {
+		select {
+		case <-ctxT.Done():
+			t.Fatal("routing table was not seeded from the snapshot")
+		case <-time.After(time.Millisecond * 5):
+		}
+	}
+}
+
+func TestRoutingTableSnapshotLimit(t *testing.T) {
+	old := rtSnapshotMaxPeers
+	rtSnapshotMaxPeers = 1
+	defer func() { rtSnapshotMaxPeers = old }()
+
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 3, t)
+	defer func() {
+		for i := 0; i < 3; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	// keep saved peers forever, and only save when asked to
+	dhts[0].SetRTSnapshotConfig(RTSnapshotConfig{})
+
+	// a peer from an earlier snapshot, no longer in the table
+	prev := []rtSnapshotPeer{{
+		ID:    peer.IDB58Encode(dhts[2].self),
+		Addrs: []string{dhts[2].host.Addrs()[0].String()},
+		Saved: time.Now().Add(-time.Hour),
+	}}
+	data, err := json.Marshal(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dhts[0].datastore.Put(rtSnapshotKey, data); err != nil {
+		t.Fatal(err)
+	}
+
+	connect(t, ctx, dhts[0], dhts[1])
+	if err := dhts[0].saveRoutingTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the current peer took the room of the old one
+	saved, err := dhts[0].loadRoutingTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].ID != dhts[1].self {
+		t.Fatalf("expected only %s to be saved, got %v", dhts[1].self, saved)
+	}
+}
+
+// if minPeers or avgPeers is 0, dont test for it.
+func waitForWellFormedTables(t *testing.T, dhts []*IpfsDHT, minPeers, avgPeers int, timeout time.Duration) bool {
+	// test "well-formed-ness" (>= minPeers peers in every routing table)
+
+	checkTables := func() bool {
+		totalPeers := 0
+		for _, dht := range dhts {
+			rtlen := dht.routingTable.Size()
+			totalPeers += rtlen
+			if minPeers > 0 && rtlen < minPeers {
+				t.Logf("routing table for %s only has %d peers (should have >%d)", dht.self, rtlen, minPeers)
+				return false
+			}
+		}
+		actualAvgPeers := totalPeers / len(dhts)
+		t.Logf("avg rt size: %d", actualAvgPeers)
+		if avgPeers > 0 && actualAvgPeers < avgPeers {
+			t.Logf("avg rt size: %d < %d", actualAvgPeers, avgPeers)
+			return false
+		}
+		return true
+	}
+
+	timeoutA := time.After(timeout)
+	for {
+		select {
+		case <-timeoutA:
+			log.Debugf("did not reach well-formed routing tables by %s", timeout)
+			return false // failed
+		case <-time.After(5 * time.Millisecond):
+			if checkTables() {
+				return true // succeeded
+			}
+		}
+	}
+}
+
+func printRoutingTables(dhts []*IpfsDHT) {
+	// the routing tables should be full now. let's inspect them.
+	fmt.Printf("checking routing table of %d\n", len(dhts))
+	for _, dht := range dhts {
+		fmt.Printf("checking routing table of %s\n", dht.self)
+		dht.routingTable.Print()
+		fmt.Println("")
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	// t.Skip("skipping test to debug another")
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	ctx := context.Background()
+
+	nDHTs := 30
+	_, _, dhts := setupDHTS(ctx, nDHTs, t)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	t.Logf("connecting %d dhts in a ring", nDHTs)
+	for i := 0; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	}
+
+	<-time.After(100 * time.Millisecond)
+	// bootstrap a few times until we get good tables.
+	stop := make(chan struct{})
+	go func() {
+		for {
+			t.Logf("bootstrapping them so they find each other %d", nDHTs)
+			ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			bootstrap(t, ctxT, dhts)
+
+			select {
+			case <-time.After(50 * time.Millisecond):
+				continue // being explicit
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	waitForWellFormedTables(t, dhts, 7, 10, 20*time.Second)
+	close(stop)
+
+	if u.Debug {
+		// the routing tables should be full now. let's inspect them.
+		printRoutingTables(dhts)
+	}
+}
+
+func TestBucketRefresh(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	self := kb.ConvertPeerID(dhts[0].self)
+	for cpl := 0; cpl < 8; cpl++ {
+		id := dhts[0].randomPeerIDWithCpl(cpl)
+		if got := commonPrefixLen(self, kb.ConvertPeerID(id)); got != cpl {
+			t.Fatalf("random ID for bucket %d has common prefix length %d", cpl, got)
+		}
+	}
+
+	connect(t, ctx, dhts[0], dhts[1])
+
+	stale := dhts[0].staleBuckets(time.Minute)
+	if len(stale) == 0 {
+		t.Fatal("expected all buckets to be stale before any lookups")
+	}
+
+	for _, cpl := range stale {
+		dhts[0].recordLookup(string(dhts[0].randomPeerIDWithCpl(cpl)))
+	}
+	if stale := dhts[0].staleBuckets(time.Minute); len(stale) != 0 {
+		t.Fatal("expected no stale buckets after lookups, got ", stale)
+	}
+}
+
+func TestReplacementCache(t *testing.T) {
+	ctx := context.Background()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	// fill the bucket for peers that share no prefix with us
+	var peers []peer.ID
+	for i := 0; i < KValue; i++ {
+		p := d.randomPeerIDWithCpl(0)
+		d.Update(ctx, p)
+		peers = append(peers, p)
+	}
+	if d.routingTable.Size() != KValue {
+		t.Fatalf("expected %d peers in the routing table, got %d", KValue, d.routingTable.Size())
+	}
+
+	// a new peer for the full bucket does not push anyone out
+	repl := d.randomPeerIDWithCpl(0)
+	d.Update(ctx, repl)
+	if d.routingTable.Find(repl) != "" {
+		t.Fatal("peer should have gone to the replacement cache")
+	}
+	for _, p := range peers {
+		if d.routingTable.Find(p) == "" {
+			t.Fatal("peer was evicted from a full bucket: ", p)
+		}
+	}
+
+	// once a peer turns out to be unreachable, the replacement takes its place
+	d.peerUnreachable(peers[0])
+	waitForEviction(t, d, peers[0])
+	if d.routingTable.Find(repl) == "" {
+		t.Fatal("replacement was not promoted into the routing table")
+	}
+}
+
+// waitForEviction waits for the ping of the unreachable peer p to fail and
+// evict it.
+func waitForEviction(t *testing.T, d *IpfsDHT, p peer.ID) {
+	timeout := time.After(5 * time.Second)
+	for d.routingTable.Find(p) != "" {
+		select {
+		case <-timeout:
+			t.Fatal("unreachable peer still in the routing table")
+		case <-time.After(time.Millisecond * 5):
+		}
+	}
+}
+
+func TestDiversityLimits(t *testing.T) {
+	ctx := context.Background()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	addPeer := func(addr string) peer.ID {
+		a, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := d.randomPeerIDWithCpl(0)
+		d.peerstore.AddAddr(p, a, pstore.PermanentAddrTTL)
+		d.Update(ctx, p)
+		return p
+	}
+
+	d.SetDiversityConfig(DiversityConfig{MaxPerBucket: 2})
+	addPeer("/ip4/1.2.3.4/tcp/4001")
+	addPeer("/ip4/1.2.3.5/tcp/4001")
+	if p := addPeer("/ip4/1.2.3.6/tcp/4001"); d.routingTable.Find(p) != "" {
+		t.Fatal("bucket limit for the /24 was not enforced")
+	}
+
+	d.SetDiversityConfig(DiversityConfig{MaxPerTable: 3})
+	addPeer("/ip4/5.6.7.1/tcp/4001")
+	addPeer("/ip4/5.6.7.2/tcp/4001")
+	addPeer("/ip4/5.6.7.3/tcp/4001")
+	if p := addPeer("/ip4/5.6.7.4/tcp/4001"); d.routingTable.Find(p) != "" {
+		t.Fatal("table limit for the /24 was not enforced")
+	}
+
+	// other prefixes and private addresses are not affected
+	if p := addPeer("/ip4/1.2.4.1/tcp/4001"); d.routingTable.Find(p) == "" {
+		t.Fatal("peer from another /24 was rejected")
+	}
+	for i := 0; i < 4; i++ {
+		if p := addPeer("/ip4/127.0.0.1/tcp/4001"); d.routingTable.Find(p) == "" {
+			t.Fatal("loopback peer was rejected")
+		}
+	}
+
+	rejected := d.DiversityRejections()
+	if len(rejected) != 2 {
+		t.Fatalf("expected 2 rejections, got %d", len(rejected))
+	}
+	if rejected[0].Prefix != "1.2.3.0/24" || rejected[0].Bucket != 0 {
+		t.Fatal("unexpected rejection: ", rejected[0])
+	}
+	if rejected[1].Prefix != "5.6.7.0/24" || rejected[1].Bucket != -1 {
+		t.Fatal("unexpected rejection: ", rejected[1])
+	}
+}
+
+func TestPeerFilter(t *testing.T) {
+	ctx := context.Background()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	bad := d.randomPeerIDWithCpl(0)
+	good := d.randomPeerIDWithCpl(0)
+
+	f := NewDenyFilter(bad)
+	d.SetPeerFilter(f.Filter)
+
+	d.Update(ctx, bad)
+	d.Update(ctx, good)
+	if d.routingTable.Find(bad) != "" {
+		t.Fatal("denied peer was added to the routing table")
+	}
+	if d.routingTable.Find(good) == "" {
+		t.Fatal("allowed peer was not added to the routing table")
+	}
+
+	// denying a peer at runtime drops it the next time we hear from it
+	f.Add(good)
+	d.Update(ctx, good)
+	if d.routingTable.Find(good) != "" {
+		t.Fatal("peer still in the routing table after being denied")
+	}
+
+	allow := NewAllowFilter(good)
+	if !allow.Filter(good) || allow.Filter(bad) {
+		t.Fatal("allowlist let the wrong peers through")
+	}
+	allow.Remove(good)
+	if allow.Filter(good) {
+		t.Fatal("allowlist still lets a removed peer through")
+	}
+}
+
+func TestRoutingTableSnapshotAPI(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	if err := dhts[0].ping(ctx, dhts[1].self); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := dhts[0].RoutingTableSnapshot()
+	if snap.Size() != 1 {
+		t.Fatalf("expected 1 peer in the snapshot, got %d", snap.Size())
+	}
+	var ps PeerSnapshot
+	for _, b := range snap.Buckets {
+		for _, p := range b.Peers {
+			ps = p
+		}
+	}
+	if ps.ID != dhts[1].self {
+		t.Fatal("unexpected peer in snapshot: ", ps.ID)
+	}
+	if len(ps.Addrs) == 0 || ps.Added.IsZero() || ps.LastUseful.IsZero() {
+		t.Fatalf("incomplete peer snapshot: %+v", ps)
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), dhts[1].self.Pretty()) {
+		t.Fatal("peer ID missing from JSON snapshot: ", string(data))
+	}
+}
+
+func TestRoutingTableEvents(t *testing.T) {
+	ctx := context.Background()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	events, cancel := d.SubscribeRoutingTable(100)
+	defer cancel()
+
+	// a subscriber that does not keep up must not block the routing table
+	_, cancelSlow := d.SubscribeRoutingTable(0)
+	defer cancelSlow()
+
+	var peers []peer.ID
+	for i := 0; i < KValue+1; i++ {
+		p := d.randomPeerIDWithCpl(i % 2)
+		d.Update(ctx, p)
+		peers = append(peers, p)
+	}
+	d.peerUnreachable(peers[0])
+	waitForEviction(t, d, peers[0])
+
+	f := NewDenyFilter(peers[1])
+	d.SetPeerFilter(f.Filter)
+	d.Update(ctx, peers[1])
+
+	counts := make(map[RoutingTableEventType]int)
+	for len(events) > 0 {
+		ev := <-events
+		counts[ev.Type]++
+	}
+	if counts[PeerAdded] != KValue+1 {
+		t.Fatalf("expected %d PeerAdded events, got %d", KValue+1, counts[PeerAdded])
+	}
+	if counts[BucketSplit] != 1 {
+		t.Fatalf("expected 1 BucketSplit event, got %d", counts[BucketSplit])
+	}
+	if counts[PeerEvicted] != 1 || counts[PeerRemoved] != 1 {
+		t.Fatalf("unexpected removal events: %v", counts)
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("expected channel to be closed after cancel")
+	}
+}
+
+func TestAddrFilter(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	var addrs []ma.Multiaddr
+	for _, s := range []string{
+		"/ip4/127.0.0.1/tcp/4001",
+		"/ip4/192.168.1.10/tcp/4001",
+		"/ip4/1.2.3.4/tcp/4001",
+		"/ip6/::1/tcp/4001",
+	} {
+		a, err := ma.NewMultiaddr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, a)
+	}
+
+	// peers we are not connected to only get public addresses
+	stranger := dhts[0].randomPeerIDWithCpl(0)
+	pi := dhts[0].filterPeerInfo(stranger, pstore.PeerInfo{ID: dhts[0].self, Addrs: addrs})
+	if len(pi.Addrs) != 1 || !pi.Addrs[0].Equal(addrs[2]) {
+		t.Fatal("expected only the public address, got ", pi.Addrs)
+	}
+
+	// peers connected over loopback get everything
+	connect(t, ctx, dhts[0], dhts[1])
+	pi = dhts[0].filterPeerInfo(dhts[1].self, pstore.PeerInfo{ID: dhts[0].self, Addrs: addrs})
+	if len(pi.Addrs) != len(addrs) {
+		t.Fatal("expected all addresses for a local peer, got ", pi.Addrs)
+	}
+
+	dhts[0].SetAddrFilter(nil)
+	pi = dhts[0].filterPeerInfo(stranger, pstore.PeerInfo{ID: dhts[0].self, Addrs: addrs})
+	if len(pi.Addrs) != len(addrs) {
+		t.Fatal("expected no filtering without an AddrFilter, got ", pi.Addrs)
+	}
+}
+
+func TestProvideNoSharedAddrs(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	c := testCaseCids[0]
+
+	// peers we are not connected to get no loopback addresses, which leaves
+	// an announcement with nothing to reach us at
+	stranger := dhts[0].randomPeerIDWithCpl(0)
+	if _, err := dhts[0].makeProvRecord(c, stranger); err != errNoSharedAddrs {
+		t.Fatal("expected an announcement without addresses to fail, got ", err)
+	}
+
+	// announcing to no one is an error
+	dhts[0].SetAddrFilter(func(peer.ID, []ma.Multiaddr) []ma.Multiaddr { return nil })
+	if err := dhts[0].Provide(ctx, c, true); err == nil {
+		t.Fatal("expected Provide to fail without addresses to share")
+	}
+	if err := dhts[0].ProvideMany(ctx, []*cid.Cid{c}); err == nil {
+		t.Fatal("expected ProvideMany to fail without addresses to share")
+	}
+	if provs := dhts[1].providers.GetProviders(ctx, c); len(provs) != 0 {
+		t.Fatal("expected no provider records without addresses, got ", provs)
+	}
+}
+
+func TestDialHistory(t *testing.T) {
+	dh := newDialHistory()
+	p := peer.ID("TestPeer")
+
+	if ct := dh.connectionType(p); ct != pb.Message_NOT_CONNECTED {
+		t.Fatal("expected NOT_CONNECTED for an unknown peer, got ", ct)
+	}
+
+	dh.dialSucceeded(p)
+	if ct := dh.connectionType(p); ct != pb.Message_CAN_CONNECT {
+		t.Fatal("expected CAN_CONNECT after a successful dial, got ", ct)
+	}
+
+	dh.dialFailed(p)
+	if ct := dh.connectionType(p); ct != pb.Message_NOT_CONNECTED {
+		t.Fatal("expected NOT_CONNECTED after a single failed dial, got ", ct)
+	}
+	dh.dialFailed(p)
+	if ct := dh.connectionType(p); ct != pb.Message_CANNOT_CONNECT {
+		t.Fatal("expected CANNOT_CONNECT after repeated failed dials, got ", ct)
+	}
+
+	dh.reportCannotConnect(peer.ID("a"), p)
+	dh.reportCannotConnect(peer.ID("a"), p)
+	if dh.reportedUnreachable(p) {
+		t.Fatal("a single reporter should not be enough")
+	}
+	dh.reportCannotConnect(peer.ID("b"), p)
+	if !dh.reportedUnreachable(p) {
+		t.Fatal("expected peer to be reported unreachable")
+	}
+
+	// our own successful dial trumps what others say
+	dh.dialSucceeded(p)
+	if dh.reportedUnreachable(p) {
+		t.Fatal("reports should be cleared by a successful dial")
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	p := dhts[1].self
+
+	// the ping tells us the peer supports request IDs, the next request
+	// finds out that it echoes them
+	if err := dhts[0].ping(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dhts[0].sendRequest(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, "key", 0)); err != nil {
+		t.Fatal(err)
+	}
+	ms := dhts[0].messageSenderForPeer(p)
+	ms.lk.Lock()
+	mux := ms.mux
+	ms.lk.Unlock()
+	dhts[0].releaseMessageSender(ms)
+	if !mux {
+		t.Fatal("expected the sender to switch to pipelined requests")
+	}
+
+	ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// a request the peer takes its time answering
+	const slowType = pb.Message_MessageType(102)
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	err := dhts[1].RegisterHandler(slowType, func(ctx context.Context, _ peer.ID, pmes *pb.Message) (*pb.Message, error) {
+		close(started)
+		<-unblock
+		return pb.NewMessage(slowType, pmes.GetKey(), 0), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		select {
+		case <-unblock:
+		default:
+			close(unblock)
+		}
+	}()
+	slowErr := make(chan error, 1)
+	go func() {
+		_, err := dhts[0].sendRequest(ctxT, p, pb.NewMessage(slowType, "slow", 0))
+		slowErr <- err
+	}()
+	<-started
+
+	// the others are answered while it is pending
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			pmes := pb.NewMessage(pb.Message_FIND_NODE, fmt.Sprintf("key%d", i), 0)
+			resp, err := dhts[0].sendRequest(ctxT, p, pmes)
+			if err == nil && resp.GetType() != pb.Message_FIND_NODE {
+				err = fmt.Errorf("unexpected response type: %s", resp.GetType())
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-slowErr:
+		t.Fatalf("slow request returned before it was answered: %v", err)
+	default:
+	}
+
+	close(unblock)
+	if err := <-slowErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	p := dhts[1].self
+
+	expectRemoteError := func(pmes *pb.Message, code pb.Message_ErrorCode) {
+		_, err := dhts[0].sendRequest(ctx, p, pmes)
+		rerr, ok := err.(*RemoteError)
+		if !ok {
+			t.Fatalf("expected a remote error, got: %v", err)
+		}
+		if rerr.Code != code || rerr.Peer != p {
+			t.Fatalf("expected %s from %s, got: %s", code, p, rerr)
+		}
+	}
+
+	expectRemoteError(pb.NewMessage(pb.Message_GET_PROVIDERS, "not a cid", 0), pb.Message_INVALID_REQUEST)
+	expectRemoteError(pb.NewMessage(pb.Message_GET_VALUE, "", 0), pb.Message_INVALID_REQUEST)
+
+	badkey := "/bad/key"
+	put := pb.NewMessage(pb.Message_PUT_VALUE, badkey, 0)
+	put.Record = &recpb.Record{Key: &badkey, Value: []byte("value")}
+	expectRemoteError(put, pb.Message_INVALID_RECORD)
+
+	// rejected requests don't take the stream down
+	if _, err := dhts[0].sendRequest(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, "key", 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	p := dhts[1].self
+
+	dhts[1].SetRateLimitConfig(RateLimitConfig{
+		PerPeer: map[pb.Message_MessageType]RateLimit{
+			pb.Message_FIND_NODE:    {Rate: 0.001, Burst: 2},
+			pb.Message_ADD_PROVIDER: {Rate: 0.001, Burst: 0},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := dhts[0].sendRequest(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, "key", 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := dhts[0].sendRequest(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, "key", 0))
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Code != pb.Message_BUSY {
+		t.Fatalf("expected a BUSY error, got: %v", err)
+	}
+	if stats := dhts[1].RateLimitStats(); stats.Rejected != 1 || stats.Dropped != 0 {
+		t.Fatalf("unexpected rate limit stats: %+v", stats)
+	}
+
+	// announcements are not answered, but counted when dropped
+	if err := dhts[0].sendMessage(ctx, p, pb.NewMessage(pb.Message_ADD_PROVIDER, "key", 0)); err != nil {
+		t.Fatal(err)
+	}
+	for dhts[1].RateLimitStats().Dropped != 1 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("dropped announcement was not counted")
+		case <-time.After(time.Millisecond * 5):
+		}
+	}
+
+	// other message types have their own limits
+	if err := dhts[0].ping(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	// the concurrency cap is shared by all peers
+	rl := newRateLimiter(RateLimitConfig{MaxConcurrentHandlers: 1})
+	done, err := rl.admit(p, pb.Message_PING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rl.admit(dhts[0].self, pb.Message_PING); err != errTooBusy {
+		t.Fatalf("expected to be too busy, got: %v", err)
+	}
+	done()
+	if _, err := rl.admit(dhts[0].self, pb.Message_PING); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockingDatastore holds up Get calls for key until unblock is closed.
+type blockingDatastore struct {
+	ds.Batching
+	key     ds.Key
+	unblock chan struct{}
+}
+
+func (d *blockingDatastore) Get(k ds.Key) (interface{}, error) {
+	if k == d.key {
+		<-d.unblock
+	}
+	return d.Batching.Get(k)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	oldTimeout := HandlerTimeout
+	HandlerTimeout = 100 * time.Millisecond
+	defer func() { HandlerTimeout = oldTimeout }()
+
+	d := setupDHT(ctx, t, false)
+	defer d.host.Close()
+	defer d.Close()
+
+	bds := &blockingDatastore{
+		Batching: dssync.MutexWrap(ds.NewMapDatastore()),
+		key:      convertToDsKey("/v/hello"),
+		unblock:  make(chan struct{}),
+	}
+	slow := NewDHT(ctx, bhost.New(netutil.GenSwarmNetwork(t, ctx)), bds)
+	defer slow.host.Close()
+	defer slow.Close()
+	defer close(bds.unblock)
+
+	connect(t, ctx, d, slow)
+
+	start := time.Now()
+	_, err := d.sendRequest(ctx, slow.self, pb.NewMessage(pb.Message_GET_VALUE, "/v/hello", 0))
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Code != pb.Message_BUSY {
+		t.Fatalf("expected a BUSY error, got: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("handler did not give up on the datastore in time")
+	}
+}
+
+func TestDatastoreCallSlots(t *testing.T) {
+	old := maxDatastoreCalls
+	maxDatastoreCalls = 1
+	defer func() { maxDatastoreCalls = old }()
+
+	ctx := context.Background()
+	d := setupDHT(ctx, t, false)
+	defer d.host.Close()
+	defer d.Close()
+
+	call := func(timeout time.Duration, f func() error) error {
+		ctxT, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return d.dsCall(ctxT, f)
+	}
+	noop := func() error { return nil }
+
+	// a call we gave up on keeps its slot while it hangs
+	hung := make(chan struct{})
+	if err := call(50*time.Millisecond, func() error { <-hung; return nil }); err != context.DeadlineExceeded {
+		t.Fatal("expected the hung call to time out, got ", err)
+	}
+	if err := call(50*time.Millisecond, noop); err != context.DeadlineExceeded {
+		t.Fatal("expected to wait for the hung call, got ", err)
+	}
+
+	close(hung)
+	if err := call(time.Second, noop); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
 	defer func() {
-		for i := 0; i < 4; i++ {
+		for i := 0; i < 2; i++ {
 			dhts[i].Close()
 			defer dhts[i].host.Close()
 		}
 	}()
 
 	connect(t, ctx, dhts[0], dhts[1])
-	connect(t, ctx, dhts[1], dhts[2])
-	connect(t, ctx, dhts[1], dhts[3])
+	p := dhts[1].self
 
-	for _, k := range testCaseCids {
-		log.Debugf("announcing provider for %s", k)
-		if err := dhts[3].Provide(ctx, k, false); err != nil {
-			t.Fatal(err)
+	const echoType = pb.Message_MessageType(100)
+	echo := func(ctx context.Context, from peer.ID, pmes *pb.Message) (*pb.Message, error) {
+		if pmes.GetKey() == "" {
+			return nil, &RemoteError{Code: pb.Message_INVALID_REQUEST, Message: "no key"}
 		}
+		return pb.NewMessage(echoType, pmes.GetKey()+" from "+string(from), 0), nil
 	}
 
-	time.Sleep(time.Millisecond * 10)
+	if err := dhts[1].RegisterHandler(pb.Message_FIND_NODE, echo); err != ErrBuiltinMessageType {
+		t.Fatalf("expected built-in types to be refused, got: %v", err)
+	}
+	if err := dhts[1].RegisterHandler(echoType, echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := dhts[1].RegisterHandler(echoType, echo); err != ErrHandlerExists {
+		t.Fatalf("expected a second handler to be refused, got: %v", err)
+	}
 
-	for _, c := range testCaseCids {
-		for i := 0; i < 3; i++ {
-			provs := dhts[i].providers.GetProviders(ctx, c)
-			if len(provs) > 0 {
-				t.Fatal("shouldnt know this")
-			}
-		}
+	resp, err := dhts[0].SendRequest(ctx, p, pb.NewMessage(echoType, "hello", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetKey() != "hello from "+string(dhts[0].self) {
+		t.Fatalf("unexpected response: %s", resp.GetKey())
+	}
+
+	_, err = dhts[0].SendRequest(ctx, p, pb.NewMessage(echoType, "", 0))
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Code != pb.Message_INVALID_REQUEST || rerr.Message != "no key" {
+		t.Fatalf("expected the handler's error, got: %v", err)
+	}
+
+	dhts[1].UnregisterHandler(echoType)
+	_, err = dhts[0].SendRequest(ctx, p, pb.NewMessage(echoType, "hello", 0))
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Code != pb.Message_UNSUPPORTED_TYPE {
+		t.Fatalf("expected an unsupported type error, got: %v", err)
 	}
 }
 
-// if minPeers or avgPeers is 0, dont test for it.
-func waitForWellFormedTables(t *testing.T, dhts []*IpfsDHT, minPeers, avgPeers int, timeout time.Duration) bool {
-	// test "well-formed-ness" (>= minPeers peers in every routing table)
+func TestCloseDrainsHandlers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	checkTables := func() bool {
-		totalPeers := 0
-		for _, dht := range dhts {
-			rtlen := dht.routingTable.Size()
-			totalPeers += rtlen
-			if minPeers > 0 && rtlen < minPeers {
-				t.Logf("routing table for %s only has %d peers (should have >%d)", dht.self, rtlen, minPeers)
-				return false
-			}
-		}
-		actualAvgPeers := totalPeers / len(dhts)
-		t.Logf("avg rt size: %d", actualAvgPeers)
-		if avgPeers > 0 && actualAvgPeers < avgPeers {
-			t.Logf("avg rt size: %d < %d", actualAvgPeers, avgPeers)
-			return false
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
 		}
-		return true
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+
+	const slowType = pb.Message_MessageType(101)
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	err := dhts[1].RegisterHandler(slowType, func(ctx context.Context, _ peer.ID, pmes *pb.Message) (*pb.Message, error) {
+		close(started)
+		<-unblock
+		return pmes, nil
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	timeoutA := time.After(timeout)
-	for {
-		select {
-		case <-timeoutA:
-			log.Debugf("did not reach well-formed routing tables by %s", timeout)
-			return false // failed
-		case <-time.After(5 * time.Millisecond):
-			if checkTables() {
-				return true // succeeded
-			}
+	reqErr := make(chan error, 1)
+	go func() {
+		_, err := dhts[0].SendRequest(ctx, dhts[1].self, pb.NewMessage(slowType, "key", 0))
+		reqErr <- err
+	}()
+	<-started
+
+	closed := make(chan struct{})
+	go func() {
+		dhts[1].Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned with a handler in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// no new work is taken on in the meantime
+	if err := dhts[1].PutValue(ctx, "/v/hello", []byte("world")); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got: %v", err)
+	}
+
+	close(unblock)
+	if err := <-reqErr; err != nil {
+		t.Fatalf("in-flight request failed: %s", err)
+	}
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		t.Fatal("Close did not return after the handler finished")
+	}
+}
+
+func TestClientCloseKeepsHandlers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
 		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+
+	// a client sharing the host of a server did not register the stream
+	// handlers, and must not remove them
+	client := NewDHTClient(ctx, dhts[1].host, dssync.MutexWrap(ds.NewMapDatastore()))
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ping opens a new stream, which the server's handler must accept
+	dhts[0].closeMessageSenders()
+	if err := dhts[0].ping(ctx, dhts[1].self); err != nil {
+		t.Fatalf("server stopped answering after the client closed: %s", err)
 	}
 }
 
-func printRoutingTables(dhts []*IpfsDHT) {
-	// the routing tables should be full now. let's inspect them.
-	fmt.Printf("checking routing table of %d\n", len(dhts))
-	for _, dht := range dhts {
-		fmt.Printf("checking routing table of %s\n", dht.self)
-		dht.routingTable.Print()
-		fmt.Println("")
+func TestCapabilities(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	p := dhts[1].self
+
+	dhts[1].AdvertiseCapability("app/echo")
+	if err := dhts[0].ping(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	caps, known := dhts[0].PeerCapabilities(p)
+	if !known {
+		t.Fatal("expected to know the peer's capabilities after a ping")
+	}
+	expected := []string{"app/echo", CapBatchProvide, CapErrorResponses, CapRequestIDs}
+	sort.Strings(expected)
+	if strings.Join(caps, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected capabilities %v, got %v", expected, caps)
+	}
+	if !dhts[0].peerHasCapability(p, CapBatchProvide) || dhts[0].peerLacksCapability(p, CapBatchProvide) {
+		t.Fatal("expected the peer to support batched provides")
+	}
+	if !dhts[0].peerLacksCapability(p, "unknown") {
+		t.Fatal("expected the peer to lack an unknown capability")
 	}
 }
 
-func TestBootstrap(t *testing.T) {
-	// t.Skip("skipping test to debug another")
-	if testing.Short() {
-		t.SkipNow()
+func TestMessageLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, _, dhts := setupDHTS(ctx, 4, t)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	for _, d := range []*IpfsDHT{dhts[0], dhts[2], dhts[3]} {
+		connect(t, ctx, d, dhts[1])
+	}
+	p := dhts[1].self
+
+	// requests over the limits are answered with an error, which does not
+	// repeat the key the requester would drop it for
+	for _, d := range dhts[:2] {
+		d.SetMessageLimits(MessageLimitsConfig{
+			PerType: map[pb.Message_MessageType]MessageLimits{
+				pb.Message_FIND_NODE: {MaxKeyLen: 8},
+			},
+		})
+	}
+	_, err := dhts[0].sendRequest(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, "a rather long key", 0))
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Code != pb.Message_INVALID_REQUEST {
+		t.Fatalf("expected an invalid request error, got: %v", err)
+	}
+	if n := dhts[1].MessageLimitStats().Requests; n != 1 {
+		t.Fatalf("expected 1 turned down request, got %d", n)
+	}
+	if n := dhts[0].MessageLimitStats().Responses; n != 0 {
+		t.Fatalf("expected the error response to get through, %d dropped", n)
+	}
+
+	// responses over the limits are dropped. dhts[1] answers with the two
+	// other peers it knows.
+	dhts[0].SetMessageLimits(MessageLimitsConfig{
+		PerType: map[pb.Message_MessageType]MessageLimits{
+			pb.Message_FIND_NODE: {MaxPeers: 1},
+		},
+	})
+	if _, err := dhts[0].sendRequest(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, "key", 0)); err == nil {
+		t.Fatal("expected the response to be dropped")
 	}
+	if n := dhts[0].MessageLimitStats().Responses; n != 1 {
+		t.Fatalf("expected 1 dropped response, got %d", n)
+	}
+}
 
+func TestStreamPool(t *testing.T) {
 	ctx := context.Background()
 
-	nDHTs := 30
-	_, _, dhts := setupDHTS(ctx, nDHTs, t)
+	_, _, dhts := setupDHTS(ctx, 2, t)
 	defer func() {
-		for i := 0; i < nDHTs; i++ {
+		for i := 0; i < 2; i++ {
 			dhts[i].Close()
 			defer dhts[i].host.Close()
 		}
 	}()
 
-	t.Logf("connecting %d dhts in a ring", nDHTs)
-	for i := 0; i < nDHTs; i++ {
-		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	connect(t, ctx, dhts[0], dhts[1])
+	d, p := dhts[0], dhts[1].self
+
+	// wait for the probe to ask the peer for its capabilities, which leaves
+	// an idle sender behind
+	ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	for {
+		if _, known := d.PeerCapabilities(p); known {
+			break
+		}
+		select {
+		case <-ctxT.Done():
+			t.Fatal("peer capabilities were not exchanged")
+		case <-time.After(time.Millisecond * 5):
+		}
 	}
+	d.smlk.Lock()
+	idle := 0
+	if pool, ok := d.strmap[p]; ok {
+		idle = len(pool.senders)
+	}
+	d.smlk.Unlock()
+	before := d.StreamPoolStats()
 
-	<-time.After(100 * time.Millisecond)
-	// bootstrap a few times until we get good tables.
-	stop := make(chan struct{})
-	go func() {
-		for {
-			t.Logf("bootstrapping them so they find each other %d", nDHTs)
-			ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
-			defer cancel()
-			bootstrap(t, ctxT, dhts)
+	// overlapping requests get their own senders, up to the limit
+	var held []*messageSender
+	for i := 0; i < MaxStreamsPerPeer+2; i++ {
+		held = append(held, d.messageSenderForPeer(p))
+	}
+	d.smlk.Lock()
+	n := len(d.strmap[p].senders)
+	d.smlk.Unlock()
+	if n != MaxStreamsPerPeer {
+		t.Fatalf("expected %d senders in the pool, got %d", MaxStreamsPerPeer, n)
+	}
+	for _, ms := range held {
+		d.releaseMessageSender(ms)
+	}
 
-			select {
-			case <-time.After(50 * time.Millisecond):
-				continue // being explicit
-			case <-stop:
-				return
-			}
+	stats := d.StreamPoolStats()
+	misses, hits := stats.Misses-before.Misses, stats.Hits-before.Hits
+	if misses != uint64(MaxStreamsPerPeer-idle) || hits != uint64(2+idle) {
+		t.Fatalf("unexpected pool stats: %d misses, %d hits with %d idle senders", misses, hits, idle)
+	}
+
+	if err := d.ping(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if d.StreamPoolStats().Hits != stats.Hits+1 {
+		t.Fatal("expected an idle sender to be reused")
+	}
+
+	// idle senders are closed and the empty pool goes away
+	d.smlk.Lock()
+	for _, ms := range d.strmap[p].senders {
+		ms.lastUsed = time.Now().Add(-2 * senderIdleTimeout)
+	}
+	d.smlk.Unlock()
+	d.sweepIdleSenders()
+
+	d.smlk.Lock()
+	_, ok := d.strmap[p]
+	d.smlk.Unlock()
+	if ok {
+		t.Fatal("expected idle senders to be swept")
+	}
+
+	// a sender closed under its holder does not open a new stream
+	ms := d.messageSenderForPeer(p)
+	ms.close()
+	if _, err := ms.SendRequest(ctx, pb.NewMessage(pb.Message_PING, "", 0)); err != errSenderClosed {
+		t.Fatal("expected a closed sender to fail, got ", err)
+	}
+	d.releaseMessageSender(ms)
+}
+
+func TestDisconnectKeepsPeer(t *testing.T) {
+	ctx := context.Background()
+
+	_, _, dhts := setupDHTS(ctx, 2, t)
+	defer func() {
+		for i := 0; i < 2; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
 		}
 	}()
 
-	waitForWellFormedTables(t, dhts, 7, 10, 20*time.Second)
-	close(stop)
+	connect(t, ctx, dhts[0], dhts[1])
+	dhts[0].host.Network().ClosePeer(dhts[1].self)
+	time.Sleep(time.Millisecond * 50)
 
-	if u.Debug {
-		// the routing tables should be full now. let's inspect them.
-		printRoutingTables(dhts)
+	if dhts[0].routingTable.Find(dhts[1].self) == "" {
+		t.Fatal("peer removed from the routing table on disconnect")
 	}
 }
 
@@ -862,6 +2165,39 @@ func TestClientModeConnect(t *testing.T) {
 	}
 }
 
+func TestClientModeNotCached(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, true)
+
+	connectNoSync(t, ctx, a, b)
+
+	// a finds out in the background that b is only a client
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+	for !a.noDHT.Contains(b.self) {
+		select {
+		case <-ctxT.Done():
+			t.Fatal("client peer was not recorded as lacking dht support")
+		case <-time.After(time.Millisecond * 5):
+		}
+	}
+	if a.routingTable.Find(b.self) != "" {
+		t.Fatal("client peer was added to the routing table")
+	}
+
+	// b still adds a, a full dht node
+	for b.routingTable.Find(a.self) == "" {
+		select {
+		case <-ctxT.Done():
+			t.Fatal("dht peer was not added to the routing table")
+		case <-time.After(time.Millisecond * 5):
+		}
+	}
+}
+
 func TestFindPeerQuery(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
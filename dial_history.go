@@ -0,0 +1,156 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+const (
+	// how long dial outcomes and CANNOT_CONNECT reports are taken into account
+	dialHistoryTTL  = 10 * time.Minute
+	dialHistorySize = 4096
+
+	// consecutive failed dials after which we report a peer as CANNOT_CONNECT
+	cannotConnectFailures = 2
+
+	// number of responders that must report a peer as CANNOT_CONNECT before
+	// we put off querying it
+	cannotConnectReporters = 2
+)
+
+type dialRecord struct {
+	lastSuccess time.Time
+	lastFailure time.Time
+	failures    int // consecutive failed dials
+
+	reporters map[peer.ID]time.Time // peers that told us they cannot connect
+}
+
+// dialHistory remembers recent dials to peers, and what other peers told us
+// about dialing them.
+type dialHistory struct {
+	lk    sync.Mutex
+	peers *lru.Cache // peer.ID -> *dialRecord
+}
+
+func newDialHistory() *dialHistory {
+	peers, err := lru.New(dialHistorySize)
+	if err != nil {
+		panic(err) //only happens if negative value is passed to lru constructor
+	}
+	return &dialHistory{peers: peers}
+}
+
+// record returns the record for p, creating it if needed. It must be called
+// with dh.lk held.
+func (dh *dialHistory) record(p peer.ID) *dialRecord {
+	if v, ok := dh.peers.Get(p); ok {
+		return v.(*dialRecord)
+	}
+	rec := &dialRecord{}
+	dh.peers.Add(p, rec)
+	return rec
+}
+
+// dialSucceeded records that we dialed p. Only dials of our own count, a
+// peer that dialed us may still be unreachable, e.g. behind a NAT.
+func (dh *dialHistory) dialSucceeded(p peer.ID) {
+	dh.lk.Lock()
+	defer dh.lk.Unlock()
+
+	rec := dh.record(p)
+	rec.lastSuccess = time.Now()
+	rec.failures = 0
+	rec.reporters = nil
+}
+
+func (dh *dialHistory) dialFailed(p peer.ID) {
+	dh.lk.Lock()
+	defer dh.lk.Unlock()
+
+	rec := dh.record(p)
+	rec.lastFailure = time.Now()
+	rec.failures++
+}
+
+// reportCannotConnect records that reporter could not connect to p.
+func (dh *dialHistory) reportCannotConnect(reporter, p peer.ID) {
+	dh.lk.Lock()
+	defer dh.lk.Unlock()
+
+	rec := dh.record(p)
+	if rec.reporters == nil {
+		rec.reporters = make(map[peer.ID]time.Time)
+	}
+	rec.reporters[reporter] = time.Now()
+}
+
+// reportedUnreachable reports whether enough peers recently told us they
+// cannot connect to p.
+func (dh *dialHistory) reportedUnreachable(p peer.ID) bool {
+	dh.lk.Lock()
+	defer dh.lk.Unlock()
+
+	v, ok := dh.peers.Peek(p)
+	if !ok {
+		return false
+	}
+	rec := v.(*dialRecord)
+
+	n := 0
+	for r, t := range rec.reporters {
+		if time.Since(t) > dialHistoryTTL {
+			delete(rec.reporters, r)
+			continue
+		}
+		n++
+	}
+	return n >= cannotConnectReporters
+}
+
+// connectionType returns the connection hint we give others about p.
+func (dh *dialHistory) connectionType(p peer.ID) pb.Message_ConnectionType {
+	dh.lk.Lock()
+	defer dh.lk.Unlock()
+
+	v, ok := dh.peers.Peek(p)
+	if !ok {
+		return pb.Message_NOT_CONNECTED
+	}
+	rec := v.(*dialRecord)
+
+	switch {
+	case rec.failures >= cannotConnectFailures && time.Since(rec.lastFailure) < dialHistoryTTL:
+		return pb.Message_CANNOT_CONNECT
+	case rec.failures == 0 && time.Since(rec.lastSuccess) < dialHistoryTTL:
+		return pb.Message_CAN_CONNECT
+	default:
+		return pb.Message_NOT_CONNECTED
+	}
+}
+
+// connectionType returns the connection hint we give others about p: whether
+// we are connected to it, and otherwise how our recent dials to it went.
+func (dht *IpfsDHT) connectionType(p peer.ID) pb.Message_ConnectionType {
+	if dht.host.Network().Connectedness(p) == inet.Connected {
+		return pb.Message_CONNECTED
+	}
+	return dht.dials.connectionType(p)
+}
+
+// recordConnectionHints takes note of the peers that from says it cannot
+// connect to.
+func (dht *IpfsDHT) recordConnectionHints(from peer.ID, pmes *pb.Message) {
+	for _, peers := range [][]*pb.Message_Peer{pmes.GetCloserPeers(), pmes.GetProviderPeers()} {
+		for _, pbp := range peers {
+			if pbp.GetConnection() == pb.Message_CANNOT_CONNECT {
+				dht.dials.reportCannotConnect(from, peer.ID(pbp.GetId()))
+			}
+		}
+	}
+}
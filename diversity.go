@@ -0,0 +1,112 @@
+package dht
+
+import (
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// DiversityConfig limits how many peers in the routing table may share a
+// network prefix (the /24 for IPv4, the /48 for IPv6), so that a single
+// operator cannot fill our buckets with many peer IDs. Peers with only
+// loopback or private addresses are not limited. A zero limit is disabled.
+type DiversityConfig struct {
+	MaxPerBucket int // peers per prefix in a single bucket
+	MaxPerTable  int // peers per prefix in the whole routing table
+}
+
+// DefaultDiversityConfig is used by newly constructed DHTs. It leaves the
+// limits disabled, as peers legitimately share prefixes, e.g. on a LAN or in
+// one hosting provider's network; enable them with SetDiversityConfig, e.g.
+// with RecommendedDiversityConfig.
+var DefaultDiversityConfig = DiversityConfig{}
+
+// RecommendedDiversityConfig is a starting point for DHTs on the public
+// network that want to limit how much of their routing table a single
+// network can take.
+var RecommendedDiversityConfig = DiversityConfig{
+	MaxPerBucket: 2,
+	MaxPerTable:  10,
+}
+
+// number of diversity rejections remembered for DiversityRejections
+const maxDiversityRejections = 128
+
+// DiversityRejection records a peer kept out of the routing table because
+// too many peers from its network prefix were in it already.
+type DiversityRejection struct {
+	Peer   peer.ID
+	Prefix string    // the network prefix that was over its limit
+	Bucket int       // the bucket that was over the limit, or -1 for the table limit
+	Time   time.Time // when the peer was turned down
+}
+
+// SetDiversityConfig changes the diversity limits of the routing table.
+// Peers already in the table are not affected.
+func (dht *IpfsDHT) SetDiversityConfig(cfg DiversityConfig) {
+	dht.rtlk.Lock()
+	defer dht.rtlk.Unlock()
+	dht.rtstate.diversity = cfg
+}
+
+// DiversityRejections returns the most recent peers that were kept out of the
+// routing table by the diversity limits, oldest first.
+func (dht *IpfsDHT) DiversityRejections() []DiversityRejection {
+	dht.rtlk.Lock()
+	defer dht.rtlk.Unlock()
+
+	out := make([]DiversityRejection, len(dht.rtstate.rejected))
+	copy(out, dht.rtstate.rejected)
+	return out
+}
+
+// checkDiversity reports whether a peer with the given common prefix length
+// and network prefixes can be added to the routing table without exceeding
+// the diversity limits, and records a rejection if not.
+func (st *rtState) checkDiversity(p peer.ID, cpl int, prefixes []string) bool {
+	cfg := st.diversity
+	if len(prefixes) == 0 || (cfg.MaxPerBucket <= 0 && cfg.MaxPerTable <= 0) {
+		return true
+	}
+
+	b := st.bucketFor(cpl)
+	for _, pfx := range prefixes {
+		inTable, inBucket := 0, 0
+		for _, pi := range st.peers {
+			for _, other := range pi.prefixes {
+				if other != pfx {
+					continue
+				}
+				inTable++
+				if st.bucketFor(pi.cpl) == b {
+					inBucket++
+				}
+				break
+			}
+		}
+
+		switch {
+		case cfg.MaxPerBucket > 0 && inBucket >= cfg.MaxPerBucket:
+			st.reject(p, pfx, b)
+			return false
+		case cfg.MaxPerTable > 0 && inTable >= cfg.MaxPerTable:
+			st.reject(p, pfx, -1)
+			return false
+		}
+	}
+	return true
+}
+
+func (st *rtState) reject(p peer.ID, pfx string, bucket int) {
+	log.Debugf("diversity limit for %s reached, not adding %s to bucket %d", pfx, p, bucket)
+
+	st.rejected = append(st.rejected, DiversityRejection{
+		Peer:   p,
+		Prefix: pfx,
+		Bucket: bucket,
+		Time:   time.Now(),
+	})
+	if len(st.rejected) > maxDiversityRejections {
+		st.rejected = st.rejected[len(st.rejected)-maxDiversityRejections:]
+	}
+}
@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"fmt"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// handlerError is returned by handlers to reject a request with a code the
+// requester can act on. Other handler errors are reported as INTERNAL_ERROR.
+type handlerError struct {
+	code pb.Message_ErrorCode
+	msg  string
+}
+
+func (e *handlerError) Error() string {
+	return e.msg
+}
+
+func errInvalidRequest(format string, args ...interface{}) error {
+	return &handlerError{code: pb.Message_INVALID_REQUEST, msg: fmt.Sprintf(format, args...)}
+}
+
+func errRejectedRecord(err error) error {
+	return &handlerError{code: pb.Message_INVALID_RECORD, msg: err.Error()}
+}
+
+// errorResponse builds the response rejecting pmes because of err. The key of
+// pmes is left out: it may be what pmes was rejected for, e.g. for being
+// over the limits, and the requester would drop the response in turn.
+func errorResponse(pmes *pb.Message, err error) *pb.Message {
+	code := pb.Message_INTERNAL_ERROR
+	msg := "internal error" // don't leak the details of our own failures
+	switch err := err.(type) {
+	case *handlerError:
+		code = err.code
+		msg = err.msg
+	case *RemoteError: // from a registered handler
+		code = err.Code
+		msg = err.Message
+	}
+
+	resp := pb.NewMessage(pmes.GetType(), "", pmes.GetClusterLevel())
+	resp.ErrorCode = &code
+	resp.ErrorMessage = &msg
+	return resp
+}
+
+// RemoteError is returned when a peer answered a request with an error, as
+// opposed to not answering at all.
+type RemoteError struct {
+	Peer    peer.ID
+	Code    pb.Message_ErrorCode
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s rejected request: %s: %s", e.Peer, e.Code, e.Message)
+}
+
+// remoteError returns the error carried by the response from p, if any.
+func remoteError(p peer.ID, rpmes *pb.Message) error {
+	if rpmes.GetErrorCode() == pb.Message_NO_ERROR {
+		return nil
+	}
+	return &RemoteError{
+		Peer:    p,
+		Code:    rpmes.GetErrorCode(),
+		Message: rpmes.GetErrorMessage(),
+	}
+}
@@ -288,3 +288,251 @@ func TestLessThanKResponses(t *testing.T) {
 	}
 	t.Fatal("Expected to recieve an error.")
 }
+
+func TestProvideManyFallback(t *testing.T) {
+	ctx := context.Background()
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	tsds := dssync.MutexWrap(ds.NewMapDatastore())
+	d := NewDHT(ctx, hosts[0], tsds)
+	d.Update(ctx, hosts[1].ID())
+
+	// Behave like a peer that does not know about batched provides.
+	keys := make(chan string, len(testCaseCids))
+	hosts[1].SetStreamHandler(ProtocolDHT, func(s inet.Stream) {
+		defer s.Close()
+
+		pbr := ggio.NewDelimitedReader(s, inet.MessageSizeMax)
+		pbw := ggio.NewDelimitedWriter(s)
+
+		for {
+			pmes := new(pb.Message)
+			if err := pbr.ReadMsg(pmes); err != nil {
+				return
+			}
+
+			switch pmes.GetType() {
+			case pb.Message_FIND_NODE:
+				if err := pbw.WriteMsg(&pb.Message{Type: pmes.Type}); err != nil {
+					return
+				}
+			case pb.Message_ADD_PROVIDER:
+				if pmes.GetKey() == "" {
+					return
+				}
+				keys <- pmes.GetKey()
+			default:
+				panic("Shouldnt recieve this.")
+			}
+		}
+	})
+
+	cids := testCaseCids[:5]
+	ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := d.ProvideMany(ctxT, cids); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]bool)
+	for len(got) < len(cids) {
+		select {
+		case k := <-keys:
+			got[k] = true
+		case <-ctxT.Done():
+			t.Fatalf("only got %d of %d provider records", len(got), len(cids))
+		}
+	}
+	for _, c := range cids {
+		if !got[c.KeyString()] {
+			t.Fatalf("missing provider record for %s", c)
+		}
+	}
+
+	if !d.noBatchProvide.Contains(hosts[1].ID()) {
+		t.Fatal("expected peer to be marked as not supporting batches")
+	}
+}
+
+func TestLegacyPeerCapabilities(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	tsds := dssync.MutexWrap(ds.NewMapDatastore())
+	d := NewDHT(ctx, hosts[0], tsds)
+	defer d.Close()
+
+	// Behave like an older node, echoing PING and PUT_VALUE requests whole
+	// and answering others with fresh messages.
+	hosts[1].SetStreamHandler(ProtocolDHT, func(s inet.Stream) {
+		defer s.Close()
+
+		pbr := ggio.NewDelimitedReader(s, inet.MessageSizeMax)
+		pbw := ggio.NewDelimitedWriter(s)
+
+		for {
+			pmes := new(pb.Message)
+			if err := pbr.ReadMsg(pmes); err != nil {
+				return
+			}
+			resp := pmes
+			switch pmes.GetType() {
+			case pb.Message_PING, pb.Message_PUT_VALUE:
+			default:
+				resp = pb.NewMessage(pmes.GetType(), pmes.GetKey(), 0)
+			}
+			if err := pbw.WriteMsg(resp); err != nil {
+				return
+			}
+		}
+	})
+
+	p := hosts[1].ID()
+	if _, known := d.PeerCapabilities(p); known {
+		t.Fatal("should not know the capabilities of a peer we did not ask")
+	}
+	if err := d.ping(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	caps, known := d.PeerCapabilities(p)
+	if !known || len(caps) != 0 {
+		t.Fatalf("expected the peer to have no capabilities, got: %v (known: %v)", caps, known)
+	}
+
+	muxing := func() bool {
+		ms := d.messageSenderForPeer(p)
+		defer d.releaseMessageSender(ms)
+		ms.lk.Lock()
+		defer ms.lk.Unlock()
+		return ms.mux
+	}
+
+	// the peer echoed the ID of the ping, but does not support request IDs
+	if _, err := d.sendRequest(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, "key", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if muxing() {
+		t.Fatal("should not pipeline requests to a peer without request ID support")
+	}
+
+	// nor does an echoed PUT_VALUE make us take it for one
+	if _, err := d.sendRequest(ctx, p, pb.NewMessage(pb.Message_PUT_VALUE, "key", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if muxing() {
+		t.Fatal("should not pipeline requests after an echoed PUT_VALUE")
+	}
+	if _, err := d.sendRequest(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, "key", 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// had we taken it for a peer supporting request IDs, its first response
+	// without an ID makes us fall back
+	ms := d.messageSenderForPeer(p)
+	ms.lk.Lock()
+	ms.mux = true
+	ms.lk.Unlock()
+	d.releaseMessageSender(ms)
+
+	if _, err := d.sendRequest(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, "key", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if muxing() {
+		t.Fatal("should stop pipelining after a response without request ID")
+	}
+}
+
+func TestSendersCleanedUp(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	ctx := context.Background()
+	mn := mocknet.New(ctx)
+
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsds := dssync.MutexWrap(ds.NewMapDatastore())
+	d := NewDHT(ctx, h, tsds)
+	defer d.Close()
+
+	// Answer every message with itself, like a ping.
+	echo := func(s inet.Stream) {
+		defer s.Close()
+
+		pbr := ggio.NewDelimitedReader(s, inet.MessageSizeMax)
+		pbw := ggio.NewDelimitedWriter(s)
+		for {
+			pmes := new(pb.Message)
+			if err := pbr.ReadMsg(pmes); err != nil {
+				return
+			}
+			if err := pbw.WriteMsg(pmes); err != nil {
+				return
+			}
+		}
+	}
+
+	nPeers := 2000
+	for i := 0; i < nPeers; i++ {
+		other, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.SetStreamHandler(ProtocolDHT, echo)
+
+		if _, err := mn.LinkPeers(h.ID(), other.ID()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mn.ConnectPeers(h.ID(), other.ID()); err != nil {
+			t.Fatal(err)
+		}
+
+		ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err = d.ping(ctxT, other.ID())
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.Network().ClosePeer(other.ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// disconnect notifications are delivered asynchronously
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		d.smlk.Lock()
+		n := len(d.strmap)
+		d.smlk.Unlock()
+
+		if n < 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d peers still have message senders", n, nPeers)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	d.Close()
+	d.smlk.Lock()
+	n := len(d.strmap)
+	d.smlk.Unlock()
+	if n != 0 {
+		t.Fatalf("expected no message senders after Close, got %d", n)
+	}
+}
@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// PeerFilter decides whether a peer may take part in routing. Peers it turns
+// down are kept out of the routing table, are not queried, and are not handed
+// out as closer peers or providers.
+type PeerFilter func(peer.ID) bool
+
+// PeerSetFilter is a PeerFilter backed by a set of peers that can be changed
+// at runtime. As an allowlist it only lets the peers in the set through, as
+// a denylist it lets every peer but those through.
+type PeerSetFilter struct {
+	allowlist bool
+	peers     map[peer.ID]struct{}
+	lk        sync.RWMutex
+}
+
+// NewAllowFilter returns a PeerSetFilter that only lets the given peers through.
+func NewAllowFilter(peers ...peer.ID) *PeerSetFilter {
+	return newPeerSetFilter(true, peers)
+}
+
+// NewDenyFilter returns a PeerSetFilter that keeps the given peers out.
+func NewDenyFilter(peers ...peer.ID) *PeerSetFilter {
+	return newPeerSetFilter(false, peers)
+}
+
+func newPeerSetFilter(allowlist bool, peers []peer.ID) *PeerSetFilter {
+	f := &PeerSetFilter{
+		allowlist: allowlist,
+		peers:     make(map[peer.ID]struct{}, len(peers)),
+	}
+	for _, p := range peers {
+		f.peers[p] = struct{}{}
+	}
+	return f
+}
+
+// Add adds p to the set.
+func (f *PeerSetFilter) Add(p peer.ID) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.peers[p] = struct{}{}
+}
+
+// Remove removes p from the set.
+func (f *PeerSetFilter) Remove(p peer.ID) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	delete(f.peers, p)
+}
+
+// Filter reports whether p may take part in routing. It is meant to be passed
+// to SetPeerFilter.
+func (f *PeerSetFilter) Filter(p peer.ID) bool {
+	f.lk.RLock()
+	defer f.lk.RUnlock()
+	_, ok := f.peers[p]
+	return ok == f.allowlist
+}
+
+// SetPeerFilter makes the dht only route through the peers f lets through,
+// or through all peers if f is nil. Peers already in the routing table are
+// dropped the next time we hear from them.
+func (dht *IpfsDHT) SetPeerFilter(f PeerFilter) {
+	dht.filterlk.Lock()
+	defer dht.filterlk.Unlock()
+	dht.peerFilter = f
+}
+
+// allowPeer reports whether the dht's PeerFilter lets p through.
+func (dht *IpfsDHT) allowPeer(p peer.ID) bool {
+	dht.filterlk.RLock()
+	f := dht.peerFilter
+	dht.filterlk.RUnlock()
+
+	if f == nil {
+		return true
+	}
+	return f(p)
+}
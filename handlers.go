@@ -2,7 +2,6 @@ package dht
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"time"
 
@@ -11,6 +10,7 @@ import (
 	ds "github.com/ipfs/go-datastore"
 	u "github.com/ipfs/go-ipfs-util"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	providers "github.com/libp2p/go-libp2p-kad-dht/providers"
 	lgbl "github.com/libp2p/go-libp2p-loggables"
 	peer "github.com/libp2p/go-libp2p-peer"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
@@ -39,7 +39,7 @@ func (dht *IpfsDHT) handlerForMsgType(t pb.Message_MessageType) dhtHandler {
 	case pb.Message_PING:
 		return dht.handlePing
 	default:
-		return nil
+		return dht.registeredHandler(t)
 	}
 }
 
@@ -53,11 +53,10 @@ func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	// first, is there even a key?
 	k := pmes.GetKey()
 	if k == "" {
-		return nil, errors.New("handleGetValue but no key was provided")
-		// TODO: send back an error response? could be bad, but the other node's hanging.
+		return nil, errInvalidRequest("handleGetValue but no key was provided")
 	}
 
-	rec, err := dht.checkLocalDatastore(k)
+	rec, err := dht.checkLocalDatastore(ctx, k)
 	if err != nil {
 		return nil, err
 	}
@@ -77,18 +76,56 @@ func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 			}
 		}
 
-		resp.CloserPeers = pb.PeerInfosToPBPeers(dht.host.Network(), closerinfos)
+		resp.CloserPeers = dht.peerInfosToPBPeers(p, closerinfos)
 	}
 
 	return resp, nil
 }
 
-func (dht *IpfsDHT) checkLocalDatastore(k string) (*recpb.Record, error) {
+// maxDatastoreCalls caps the number of datastore operations handlers run at
+// once, including the ones they gave up on that are still running.
+var maxDatastoreCalls = 256
+
+// dsCall runs f, a datastore operation, giving up when ctx is done. Datastore
+// calls cannot be interrupted, so f keeps running in the background, and
+// holds on to its slot until it returns: a hung datastore makes further
+// calls wait for a slot, rather than pile up.
+func (dht *IpfsDHT) dsCall(ctx context.Context, f func() error) error {
+	select {
+	case dht.dsSlots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := ctx.Err(); err != nil {
+		<-dht.dsSlots
+		return err
+	}
+
+	// Close waits for f too. Handlers run as work Close waits for, so the
+	// count cannot drop to zero under us.
+	dht.work.Add(1)
+	errc := make(chan error, 1)
+	go func() {
+		defer dht.doneWork()
+		defer func() { <-dht.dsSlots }()
+		errc <- f()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (dht *IpfsDHT) checkLocalDatastore(ctx context.Context, k string) (*recpb.Record, error) {
 	log.Debugf("%s handleGetValue looking into ds", dht.self)
 	dskey := convertToDsKey(k)
-	iVal, err := dht.datastore.Get(dskey)
-	log.Debugf("%s handleGetValue looking into ds GOT %v", dht.self, iVal)
-
+	var iVal interface{}
+	err := dht.dsCall(ctx, func() (err error) {
+		iVal, err = dht.datastore.Get(dskey)
+		return err
+	})
 	if err == ds.ErrNotFound {
 		return nil, nil
 	}
@@ -97,6 +134,7 @@ func (dht *IpfsDHT) checkLocalDatastore(k string) (*recpb.Record, error) {
 	if err != nil {
 		return nil, err
 	}
+	log.Debugf("%s handleGetValue looking into ds GOT %v", dht.self, iVal)
 
 	// if we have the value, send it back
 	log.Debugf("%s handleGetValue success!", dht.self)
@@ -154,12 +192,12 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	rec := pmes.GetRecord()
 	if rec == nil {
 		log.Infof("Got nil record from: %s", p.Pretty())
-		return nil, errors.New("nil record")
+		return nil, errInvalidRequest("nil record")
 	}
 
 	if err := dht.verifyRecordLocally(rec); err != nil {
 		log.Warningf("Bad dht record in PUT from: %s. %s", peer.ID(pmes.GetRecord().GetAuthor()), err)
-		return nil, err
+		return nil, errRejectedRecord(err)
 	}
 
 	// record the time we receive every record
@@ -170,14 +208,21 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 		return nil, err
 	}
 
-	err = dht.datastore.Put(dskey, data)
+	err = dht.dsCall(ctx, func() error {
+		return dht.datastore.Put(dskey, data)
+	})
 	log.Debugf("%s handlePutValue %v", dht.self, dskey)
 	return pmes, err
 }
 
 func (dht *IpfsDHT) handlePing(_ context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
 	log.Debugf("%s Responding to ping from %s!\n", dht.self, p)
-	return pmes, nil
+
+	// tell the peer what we support. Older nodes echo the request, so
+	// requests do not carry capabilities themselves.
+	resp := pb.NewMessage(pb.Message_PING, "", pmes.GetClusterLevel())
+	resp.Capabilities = dht.capabilities()
+	return resp, nil
 }
 
 func (dht *IpfsDHT) handleFindPeer(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
@@ -200,13 +245,14 @@ func (dht *IpfsDHT) handleFindPeer(ctx context.Context, p peer.ID, pmes *pb.Mess
 	var withAddresses []pstore.PeerInfo
 	closestinfos := pstore.PeerInfos(dht.peerstore, closest)
 	for _, pi := range closestinfos {
+		pi = dht.filterPeerInfo(p, pi)
 		if len(pi.Addrs) > 0 {
 			withAddresses = append(withAddresses, pi)
 			log.Debugf("handleFindPeer: sending back '%s'", pi.ID)
 		}
 	}
 
-	resp.CloserPeers = pb.PeerInfosToPBPeers(dht.host.Network(), withAddresses)
+	resp.CloserPeers = dht.encodePeerInfos(withAddresses)
 	return resp, nil
 }
 
@@ -218,7 +264,7 @@ func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.
 	resp := pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel())
 	c, err := cid.Cast([]byte(pmes.GetKey()))
 	if err != nil {
-		return nil, err
+		return nil, errInvalidRequest("invalid key: %s", err)
 	}
 
 	lm["key"] = func() interface{} { return c.String() }
@@ -229,30 +275,52 @@ func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.
 	defer log.Debugf("%s end", reqDesc)
 
 	// check if we have this value, to add ourselves as provider.
-	has, err := dht.datastore.Has(convertToDsKey(c.KeyString()))
+	var has bool
+	err = dht.dsCall(ctx, func() (err error) {
+		has, err = dht.datastore.Has(convertToDsKey(c.KeyString()))
+		return err
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil && err != ds.ErrNotFound {
 		log.Debugf("unexpected datastore error: %v\n", err)
 		has = false
 	}
 
 	// setup providers
-	providers := dht.providers.GetProviders(ctx, c)
+	var provs []providers.ProviderInfo
+	for _, prov := range dht.providers.GetProviderInfos(ctx, c) {
+		if dht.allowPeer(prov.ID) {
+			provs = append(provs, prov)
+		}
+	}
+	// the provider manager returns nothing when the deadline passes
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if has {
-		providers = append(providers, dht.self)
+		provs = append(provs, providers.ProviderInfo{
+			PeerInfo: pstore.PeerInfo{ID: dht.self},
+		})
 		log.Debugf("%s have the value. added self as provider", reqDesc)
 	}
 
-	if providers != nil && len(providers) > 0 {
-		infos := pstore.PeerInfos(dht.peerstore, providers)
-		resp.ProviderPeers = pb.PeerInfosToPBPeers(dht.host.Network(), infos)
-		log.Debugf("%s have %d providers: %s", reqDesc, len(providers), infos)
+	// stay within what peers accept in a response
+	if max := dht.maxPeers(pb.Message_GET_PROVIDERS); max > 0 && len(provs) > max {
+		provs = provs[:max]
+	}
+
+	if len(provs) > 0 {
+		resp.ProviderPeers = dht.providerInfosToPBPeers(p, provs)
+		log.Debugf("%s have %d providers: %s", reqDesc, len(provs), provs)
 	}
 
 	// Also send closer peers.
 	closer := dht.betterPeersToQuery(pmes, p, CloserPeerCount)
 	if closer != nil {
 		infos := pstore.PeerInfos(dht.peerstore, closer)
-		resp.CloserPeers = pb.PeerInfosToPBPeers(dht.host.Network(), infos)
+		resp.CloserPeers = dht.peerInfosToPBPeers(p, infos)
 		log.Debugf("%s have %d closer peers: %s", reqDesc, len(closer), infos)
 	}
 
@@ -264,14 +332,32 @@ func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.M
 	lm["peer"] = func() interface{} { return p.Pretty() }
 
 	defer log.EventBegin(ctx, "handleAddProvider", lm).Done()
-	c, err := cid.Cast([]byte(pmes.GetKey()))
-	if err != nil {
-		return nil, err
-	}
 
-	lm["key"] = func() interface{} { return c.String() }
+	// batched announcements carry their keys in providerKeys, and expect
+	// an acknowledgement.
+	batch := len(pmes.GetProviderKeys()) > 0
+
+	var keys []*cid.Cid
+	if batch {
+		for _, k := range pmes.GetProviderKeys() {
+			c, err := cid.Cast(k)
+			if err != nil {
+				log.Debugf("%s got invalid key in batched provide from %s: %s", dht.self, p, err)
+				continue
+			}
+			keys = append(keys, c)
+		}
+		lm["keys"] = func() interface{} { return len(keys) }
+	} else {
+		c, err := cid.Cast([]byte(pmes.GetKey()))
+		if err != nil {
+			return nil, errInvalidRequest("invalid key: %s", err)
+		}
+		keys = append(keys, c)
+		lm["key"] = func() interface{} { return c.String() }
+	}
 
-	log.Debugf("%s adding %s as a provider for '%s'\n", dht.self, p, c)
+	log.Debugf("%s adding %s as a provider for %d keys\n", dht.self, p, len(keys))
 
 	// add provider should use the address given in the message
 	pinfos := pb.PBPeersToPeerInfos(pmes.GetProviderPeers())
@@ -288,17 +374,50 @@ func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.M
 			continue
 		}
 
-		log.Infof("received provider %s for %s (addrs: %s)", p, c, pi.Addrs)
+		log.Infof("received provider %s for %d keys (addrs: %s)", p, len(keys), pi.Addrs)
 		if pi.ID != dht.self { // dont add own addrs.
 			// add the received addresses to our peerstore.
 			dht.peerstore.AddAddrs(pi.ID, pi.Addrs, pstore.ProviderAddrTTL)
 		}
-		dht.providers.AddProvider(ctx, c, p)
+		for _, c := range keys {
+			dht.providers.AddProviderInfo(ctx, c, *pi)
+			dht.learnedProvider(c)
+		}
 	}
 
+	// the provider manager drops records it did not take in before the deadline
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	if batch {
+		return pb.NewMessage(pb.Message_ADD_PROVIDER, "", pmes.GetClusterLevel()), nil
+	}
 	return nil, nil
 }
 
+// providerInfosToPBPeers encodes provider records for a GET_PROVIDERS
+// response, including the remaining validity of each record. Providers
+// without stored addresses (such as ourselves) use the peerstore's.
+func (dht *IpfsDHT) providerInfosToPBPeers(to peer.ID, provs []providers.ProviderInfo) []*pb.Message_Peer {
+	infos := make([]pstore.PeerInfo, len(provs))
+	for i, prov := range provs {
+		infos[i] = prov.PeerInfo
+		if len(infos[i].Addrs) == 0 {
+			infos[i].Addrs = dht.peerstore.Addrs(prov.ID)
+		}
+	}
+
+	now := time.Now()
+	pbps := dht.peerInfosToPBPeers(to, infos)
+	for i, prov := range provs {
+		if prov.Expires.After(now) {
+			pbps[i].SetValidity(prov.Expires.Sub(now))
+		}
+	}
+	return pbps
+}
+
 func convertToDsKey(s string) ds.Key {
 	return ds.NewKey(base32.RawStdEncoding.EncodeToString([]byte(s)))
 }
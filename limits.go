@@ -0,0 +1,146 @@
+package dht
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	proto "github.com/gogo/protobuf/proto"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// MessageLimits bounds the contents of messages of one type. A zero limit is
+// disabled.
+type MessageLimits struct {
+	MaxKeyLen       int // bytes in the key, and in each batched provider key
+	MaxRecordSize   int // bytes in the marshalled record
+	MaxPeers        int // entries in closerPeers, and in providerPeers
+	MaxAddrsPerPeer int // addresses of each of those peers
+}
+
+// MessageLimitsConfig bounds the messages we accept, both requests from other
+// peers and the responses to our own.
+//
+// Requests over a limit are not handled. Requesters waiting for a response
+// are answered with an INVALID_REQUEST error and may go on using the stream,
+// as the request was read whole. Requests over MaxMessageSize cannot be read,
+// so the stream is closed instead. Responses over a limit are dropped, and
+// the request fails.
+type MessageLimitsConfig struct {
+	// MaxMessageSize is the largest message we read off a stream. It applies
+	// to streams opened after it was set.
+	MaxMessageSize int
+
+	// PerType holds the limits for each message type. Types without an entry
+	// are only bound by MaxMessageSize.
+	PerType map[pb.Message_MessageType]MessageLimits
+}
+
+// DefaultMessageLimits is used by newly constructed DHTs. Peer lists may hold
+// twice KValue peers, provider lists are longer, and provider announcements
+// only ever carry the announcing peer.
+var DefaultMessageLimits = MessageLimitsConfig{
+	MaxMessageSize: inet.MessageSizeMax,
+	PerType: map[pb.Message_MessageType]MessageLimits{
+		pb.Message_PUT_VALUE:     {MaxKeyLen: 256, MaxRecordSize: 10 << 10, MaxPeers: 40, MaxAddrsPerPeer: 100},
+		pb.Message_GET_VALUE:     {MaxKeyLen: 256, MaxRecordSize: 10 << 10, MaxPeers: 40, MaxAddrsPerPeer: 100},
+		pb.Message_FIND_NODE:     {MaxKeyLen: 256, MaxPeers: 40, MaxAddrsPerPeer: 100},
+		pb.Message_GET_PROVIDERS: {MaxKeyLen: 256, MaxPeers: 200, MaxAddrsPerPeer: 100},
+		pb.Message_ADD_PROVIDER:  {MaxKeyLen: 256, MaxPeers: 1, MaxAddrsPerPeer: 100},
+		pb.Message_PING:          {MaxKeyLen: 256},
+	},
+}
+
+// MessageLimitStats counts the messages turned down for being over the limits.
+type MessageLimitStats struct {
+	Requests  uint64 // requests from other peers
+	Responses uint64 // responses to our requests
+}
+
+// SetMessageLimits changes the limits on the messages we accept. cfg must not
+// be modified afterwards.
+func (dht *IpfsDHT) SetMessageLimits(cfg MessageLimitsConfig) {
+	dht.limitlk.Lock()
+	defer dht.limitlk.Unlock()
+	dht.msgLimits = cfg
+}
+
+// MessageLimitStats returns the number of messages turned down so far for
+// being over the limits.
+func (dht *IpfsDHT) MessageLimitStats() MessageLimitStats {
+	return MessageLimitStats{
+		Requests:  atomic.LoadUint64(&dht.limitStats.Requests),
+		Responses: atomic.LoadUint64(&dht.limitStats.Responses),
+	}
+}
+
+func (dht *IpfsDHT) messageLimits() MessageLimitsConfig {
+	dht.limitlk.RLock()
+	defer dht.limitlk.RUnlock()
+	return dht.msgLimits
+}
+
+// maxMessageSize returns the largest message to read off a new stream.
+func (dht *IpfsDHT) maxMessageSize() int {
+	if size := dht.messageLimits().MaxMessageSize; size > 0 {
+		return size
+	}
+	return inet.MessageSizeMax
+}
+
+// maxPeers returns the number of peers a list in a message of type t may
+// hold, or 0 if it is not limited.
+func (dht *IpfsDHT) maxPeers(t pb.Message_MessageType) int {
+	return dht.messageLimits().PerType[t].MaxPeers
+}
+
+// checkMessage returns an error if pmes is over the limits for its type.
+func (dht *IpfsDHT) checkMessage(pmes *pb.Message) error {
+	lim, ok := dht.messageLimits().PerType[pmes.GetType()]
+	if !ok {
+		return nil
+	}
+
+	if lim.MaxKeyLen > 0 {
+		if len(pmes.GetKey()) > lim.MaxKeyLen {
+			return errInvalidRequest("key of %d bytes, over the limit of %d", len(pmes.GetKey()), lim.MaxKeyLen)
+		}
+		for _, k := range pmes.GetProviderKeys() {
+			if len(k) > lim.MaxKeyLen {
+				return errInvalidRequest("provider key of %d bytes, over the limit of %d", len(k), lim.MaxKeyLen)
+			}
+		}
+	}
+
+	if rec := pmes.GetRecord(); lim.MaxRecordSize > 0 && rec != nil {
+		if size := proto.Size(rec); size > lim.MaxRecordSize {
+			return errInvalidRequest("record of %d bytes, over the limit of %d", size, lim.MaxRecordSize)
+		}
+	}
+
+	for _, peers := range [][]*pb.Message_Peer{pmes.GetCloserPeers(), pmes.GetProviderPeers()} {
+		if lim.MaxPeers > 0 && len(peers) > lim.MaxPeers {
+			return errInvalidRequest("%d peers, over the limit of %d", len(peers), lim.MaxPeers)
+		}
+		if lim.MaxAddrsPerPeer <= 0 {
+			continue
+		}
+		for _, pbp := range peers {
+			if len(pbp.GetAddrs()) > lim.MaxAddrsPerPeer {
+				return errInvalidRequest("peer with %d addresses, over the limit of %d", len(pbp.GetAddrs()), lim.MaxAddrsPerPeer)
+			}
+		}
+	}
+	return nil
+}
+
+// checkResponse returns an error if the response rpmes from p is over the
+// limits, and counts it.
+func (dht *IpfsDHT) checkResponse(p peer.ID, rpmes *pb.Message) error {
+	if err := dht.checkMessage(rpmes); err != nil {
+		atomic.AddUint64(&dht.limitStats.Responses, 1)
+		return fmt.Errorf("dropped response from %s: %s", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	cid "github.com/ipfs/go-cid"
+)
+
+// negativeCache remembers keys for which a provider lookup recently came
+// back empty, so that repeated lookups for missing content can be answered
+// without querying the network.
+type negativeCache struct {
+	// accessed atomically, kept first for 64-bit alignment
+	hits   uint64
+	misses uint64
+
+	ttl     time.Duration
+	entries *lru.Cache // key string -> expiry time.Time
+}
+
+// NegativeCacheStats reports how effective the provider negative cache is.
+type NegativeCacheStats struct {
+	// Hits is the number of lookups answered from the cache.
+	Hits uint64
+	// Misses is the number of lookups that went to the network.
+	Misses uint64
+}
+
+func newNegativeCache(ttl time.Duration, size int) (*negativeCache, error) {
+	entries, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &negativeCache{
+		ttl:     ttl,
+		entries: entries,
+	}, nil
+}
+
+// has reports whether a lookup for k recently found no providers, and
+// counts the outcome.
+func (nc *negativeCache) has(k *cid.Cid) bool {
+	if v, ok := nc.entries.Get(k.KeyString()); ok {
+		if time.Now().Before(v.(time.Time)) {
+			atomic.AddUint64(&nc.hits, 1)
+			return true
+		}
+		nc.entries.Remove(k.KeyString())
+	}
+	atomic.AddUint64(&nc.misses, 1)
+	return false
+}
+
+func (nc *negativeCache) add(k *cid.Cid) {
+	nc.entries.Add(k.KeyString(), time.Now().Add(nc.ttl))
+}
+
+func (nc *negativeCache) remove(k *cid.Cid) {
+	nc.entries.Remove(k.KeyString())
+}
+
+func (nc *negativeCache) stats() NegativeCacheStats {
+	return NegativeCacheStats{
+		Hits:   atomic.LoadUint64(&nc.hits),
+		Misses: atomic.LoadUint64(&nc.misses),
+	}
+}
+
+// negCacheHolder guards the optional negative cache of an IpfsDHT.
+type negCacheHolder struct {
+	lk sync.RWMutex
+	nc *negativeCache
+}
+
+// EnableProviderNegativeCache makes FindProvidersAsync remember keys for
+// which no providers were found for ttl, and return no providers for them
+// without querying the network until then. Up to size keys are remembered.
+// Learning about a provider for a key, through Provide or an ADD_PROVIDER
+// message, removes it from the cache. Calling it again replaces the cache.
+func (dht *IpfsDHT) EnableProviderNegativeCache(ttl time.Duration, size int) error {
+	nc, err := newNegativeCache(ttl, size)
+	if err != nil {
+		return err
+	}
+
+	dht.negcache.lk.Lock()
+	dht.negcache.nc = nc
+	dht.negcache.lk.Unlock()
+	return nil
+}
+
+// DisableProviderNegativeCache turns the negative cache off and drops its
+// contents.
+func (dht *IpfsDHT) DisableProviderNegativeCache() {
+	dht.negcache.lk.Lock()
+	dht.negcache.nc = nil
+	dht.negcache.lk.Unlock()
+}
+
+// ProviderNegativeCacheStats returns the hit and miss counts of the negative
+// cache. It returns zero counts if the cache is disabled.
+func (dht *IpfsDHT) ProviderNegativeCacheStats() NegativeCacheStats {
+	if nc := dht.providerNegativeCache(); nc != nil {
+		return nc.stats()
+	}
+	return NegativeCacheStats{}
+}
+
+// providerNegativeCache returns the negative cache, or nil if it is disabled.
+func (dht *IpfsDHT) providerNegativeCache() *negativeCache {
+	dht.negcache.lk.RLock()
+	defer dht.negcache.lk.RUnlock()
+	return dht.negcache.nc
+}
+
+// learnedProvider must be called whenever we learn of a provider for k.
+func (dht *IpfsDHT) learnedProvider(k *cid.Cid) {
+	if nc := dht.providerNegativeCache(); nc != nil {
+		nc.remove(k)
+	}
+}
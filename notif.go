@@ -1,9 +1,13 @@
 package dht
 
 import (
+	"context"
 	"io"
+	"time"
 
+	goprocess "github.com/jbenet/goprocess"
 	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
 	ma "github.com/multiformats/go-multiaddr"
 	mstream "github.com/multiformats/go-multistream"
 )
@@ -23,24 +27,12 @@ func (nn *netNotifiee) Connected(n inet.Network, v inet.Conn) {
 	default:
 	}
 
-	// Note: We *could* just check the peerstore to see if the remote side supports the dht
-	// protocol, but its not clear that that information will make it into the peerstore
-	// by the time this notification is sent. So just to be very careful, we brute force this
-	// and open a new stream
-	s, err := dht.host.NewStream(dht.Context(), v.RemotePeer(), ProtocolDHT, ProtocolDHTOld)
-	switch err {
-	case nil:
-		s.Close()
-		// connected fine? full dht node
-		dht.Update(dht.Context(), v.RemotePeer())
-	case mstream.ErrNotSupported:
-		// Client mode only, don't bother adding them to our routing table
-	case io.EOF:
-		// This is kindof an error, but it happens someone often so make it a warning
-		log.Warningf("checking dht client type: %s", err)
+	// Finding out whether the peer is a full dht node may take a round trip,
+	// so leave it to the probe workers rather than holding up the notifier.
+	select {
+	case dht.probeq <- v.RemotePeer():
 	default:
-		// real error? thats odd
-		log.Errorf("checking dht client type: %s", err)
+		log.Warningf("dht probe queue full, not checking %s", v.RemotePeer())
 	}
 }
 
@@ -51,10 +43,98 @@ func (nn *netNotifiee) Disconnected(n inet.Network, v inet.Conn) {
 		return
 	default:
 	}
-	dht.routingTable.Remove(v.RemotePeer())
+
+	// Connections get trimmed all the time while the peer stays alive, so
+	// losing the connection is no reason to drop the peer from the routing
+	// table. Unresponsive peers are evicted when we fail to reach them.
+	// Our streams to it are gone though.
+	p := v.RemotePeer()
+	if n.Connectedness(p) != inet.Connected {
+		dht.dropMessageSenders(p)
+	}
 }
 
 func (nn *netNotifiee) OpenedStream(n inet.Network, v inet.Stream) {}
 func (nn *netNotifiee) ClosedStream(n inet.Network, v inet.Stream) {}
 func (nn *netNotifiee) Listen(n inet.Network, a ma.Multiaddr)      {}
 func (nn *netNotifiee) ListenClose(n inet.Network, a ma.Multiaddr) {}
+
+const (
+	probeWorkers   = 4
+	probeQueueSize = 256
+
+	// how long we wait for a peer to accept a dht stream when probing it
+	probeTimeout = 10 * time.Second
+
+	// how long we remember that a peer does not speak the dht protocol
+	noDHTCacheTTL  = 10 * time.Minute
+	noDHTCacheSize = 1024
+)
+
+// startProbeWorkers starts the workers that check newly connected peers for
+// dht support.
+func (dht *IpfsDHT) startProbeWorkers() {
+	for i := 0; i < probeWorkers; i++ {
+		dht.proc.Go(dht.probeWorker)
+	}
+}
+
+func (dht *IpfsDHT) probeWorker(proc goprocess.Process) {
+	for {
+		select {
+		case p := <-dht.probeq:
+			if dht.supportsDHT(p) {
+				dht.Update(dht.Context(), p)
+				// the peer may take a while to answer, don't hold up probing
+				dht.goTracked(func() { dht.exchangeCapabilities(p) })
+			}
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+// supportsDHT reports whether p is a full dht node. It trusts what the
+// peerstore knows about p's protocols, and only opens a stream to p when the
+// peerstore has nothing on it yet.
+func (dht *IpfsDHT) supportsDHT(p peer.ID) bool {
+	if v, ok := dht.noDHT.Get(p); ok {
+		if time.Now().Before(v.(time.Time)) {
+			return false
+		}
+		dht.noDHT.Remove(p)
+	}
+
+	protos, err := dht.peerstore.SupportsProtocols(p, string(ProtocolDHT), string(ProtocolDHTOld))
+	if err == nil && len(protos) > 0 {
+		return true
+	}
+
+	// identify has run, and the peer did not list the dht protocol.
+	if known, err := dht.peerstore.GetProtocols(p); err == nil && len(known) > 0 {
+		dht.noDHT.Add(p, time.Now().Add(noDHTCacheTTL))
+		return false
+	}
+
+	// peers that never answer must not hold up the probe workers
+	ctx, cancel := context.WithTimeout(dht.Context(), probeTimeout)
+	defer cancel()
+
+	s, err := dht.host.NewStream(ctx, p, ProtocolDHT, ProtocolDHTOld)
+	switch err {
+	case nil:
+		s.Close()
+		// connected fine? full dht node
+		return true
+	case mstream.ErrNotSupported:
+		// Client mode only, don't bother adding them to our routing table
+		dht.noDHT.Add(p, time.Now().Add(noDHTCacheTTL))
+	case io.EOF:
+		// This is kindof an error, but it happens someone often so make it a warning
+		log.Warningf("checking dht client type: %s", err)
+	default:
+		// real error? thats odd
+		log.Errorf("checking dht client type: %s", err)
+	}
+	return false
+}
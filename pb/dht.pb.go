@@ -112,6 +112,57 @@ func (x *Message_ConnectionType) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type Message_ErrorCode int32
+
+const (
+	// the request was handled (default)
+	Message_NO_ERROR Message_ErrorCode = 0
+	// the request could not be handled for reasons on the receiver's side
+	Message_INTERNAL_ERROR Message_ErrorCode = 1
+	// the request was malformed, e.g. a missing key or an invalid CID
+	Message_INVALID_REQUEST Message_ErrorCode = 2
+	// the record in a PUT_VALUE request did not validate
+	Message_INVALID_RECORD Message_ErrorCode = 3
+	// the receiver does not handle this message type
+	Message_UNSUPPORTED_TYPE Message_ErrorCode = 4
+	// the receiver is over its request limits, the request may be retried later
+	Message_BUSY Message_ErrorCode = 5
+)
+
+var Message_ErrorCode_name = map[int32]string{
+	0: "NO_ERROR",
+	1: "INTERNAL_ERROR",
+	2: "INVALID_REQUEST",
+	3: "INVALID_RECORD",
+	4: "UNSUPPORTED_TYPE",
+	5: "BUSY",
+}
+var Message_ErrorCode_value = map[string]int32{
+	"NO_ERROR":         0,
+	"INTERNAL_ERROR":   1,
+	"INVALID_REQUEST":  2,
+	"INVALID_RECORD":   3,
+	"UNSUPPORTED_TYPE": 4,
+	"BUSY":             5,
+}
+
+func (x Message_ErrorCode) Enum() *Message_ErrorCode {
+	p := new(Message_ErrorCode)
+	*p = x
+	return p
+}
+func (x Message_ErrorCode) String() string {
+	return proto.EnumName(Message_ErrorCode_name, int32(x))
+}
+func (x *Message_ErrorCode) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(Message_ErrorCode_value, data, "Message_ErrorCode")
+	if err != nil {
+		return err
+	}
+	*x = Message_ErrorCode(value)
+	return nil
+}
+
 type Message struct {
 	// defines what type of message it is.
 	Type *Message_MessageType `protobuf:"varint,1,opt,name=type,enum=dht.pb.Message_MessageType" json:"type,omitempty"`
@@ -128,8 +179,23 @@ type Message struct {
 	CloserPeers []*Message_Peer `protobuf:"bytes,8,rep,name=closerPeers" json:"closerPeers,omitempty"`
 	// Used to return Providers
 	// GET_VALUE, ADD_PROVIDER, GET_PROVIDERS
-	ProviderPeers    []*Message_Peer `protobuf:"bytes,9,rep,name=providerPeers" json:"providerPeers,omitempty"`
-	XXX_unrecognized []byte          `json:"-"`
+	ProviderPeers []*Message_Peer `protobuf:"bytes,9,rep,name=providerPeers" json:"providerPeers,omitempty"`
+	// Used to announce several keys in one message. When set, key is left
+	// empty and the receiver acknowledges with an empty ADD_PROVIDER message.
+	// ADD_PROVIDER
+	ProviderKeys [][]byte `protobuf:"bytes,11,rep,name=providerKeys" json:"providerKeys,omitempty"`
+	// Set by the sender of a request and echoed back in the response, so
+	// that several requests can be outstanding on one stream. Requests that
+	// carry an ID may be answered out of order.
+	RequestId *uint64 `protobuf:"varint,12,opt,name=requestId" json:"requestId,omitempty"`
+	// Set by the receiver when it rejects a request, in place of the usual
+	// response fields. errorMessage is a human readable description.
+	ErrorCode    *Message_ErrorCode `protobuf:"varint,13,opt,name=errorCode,enum=dht.pb.Message_ErrorCode" json:"errorCode,omitempty"`
+	ErrorMessage *string            `protobuf:"bytes,14,opt,name=errorMessage" json:"errorMessage,omitempty"`
+	// The optional features the sender supports, by name.
+	// PING (responses only)
+	Capabilities     []string `protobuf:"bytes,15,rep,name=capabilities" json:"capabilities,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
 }
 
 func (m *Message) Reset()         { *m = Message{} }
@@ -178,14 +244,52 @@ func (m *Message) GetProviderPeers() []*Message_Peer {
 	return nil
 }
 
+func (m *Message) GetProviderKeys() [][]byte {
+	if m != nil {
+		return m.ProviderKeys
+	}
+	return nil
+}
+
+func (m *Message) GetRequestId() uint64 {
+	if m != nil && m.RequestId != nil {
+		return *m.RequestId
+	}
+	return 0
+}
+
+func (m *Message) GetErrorCode() Message_ErrorCode {
+	if m != nil && m.ErrorCode != nil {
+		return *m.ErrorCode
+	}
+	return Message_NO_ERROR
+}
+
+func (m *Message) GetErrorMessage() string {
+	if m != nil && m.ErrorMessage != nil {
+		return *m.ErrorMessage
+	}
+	return ""
+}
+
+func (m *Message) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
 type Message_Peer struct {
 	// ID of a given peer.
 	Id *string `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
 	// multiaddrs for a given peer
 	Addrs [][]byte `protobuf:"bytes,2,rep,name=addrs" json:"addrs,omitempty"`
 	// used to signal the sender's connection capabilities to the peer
-	Connection       *Message_ConnectionType `protobuf:"varint,3,opt,name=connection,enum=dht.pb.Message_ConnectionType" json:"connection,omitempty"`
-	XXX_unrecognized []byte                  `json:"-"`
+	Connection *Message_ConnectionType `protobuf:"varint,3,opt,name=connection,enum=dht.pb.Message_ConnectionType" json:"connection,omitempty"`
+	// remaining validity of a provider record, in seconds
+	// GET_PROVIDERS (providerPeers only)
+	Validity         *uint64 `protobuf:"varint,4,opt,name=validity" json:"validity,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
 }
 
 func (m *Message_Peer) Reset()         { *m = Message_Peer{} }
@@ -213,9 +317,17 @@ func (m *Message_Peer) GetConnection() Message_ConnectionType {
 	return Message_NOT_CONNECTED
 }
 
+func (m *Message_Peer) GetValidity() uint64 {
+	if m != nil && m.Validity != nil {
+		return *m.Validity
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Message)(nil), "dht.pb.Message")
 	proto.RegisterType((*Message_Peer)(nil), "dht.pb.Message.Peer")
 	proto.RegisterEnum("dht.pb.Message_MessageType", Message_MessageType_name, Message_MessageType_value)
 	proto.RegisterEnum("dht.pb.Message_ConnectionType", Message_ConnectionType_name, Message_ConnectionType_value)
+	proto.RegisterEnum("dht.pb.Message_ErrorCode", Message_ErrorCode_name, Message_ErrorCode_value)
 }
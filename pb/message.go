@@ -1,6 +1,8 @@
 package dht_pb
 
 import (
+	"time"
+
 	logging "github.com/ipfs/go-log"
 	b58 "github.com/jbenet/go-base58"
 	inet "github.com/libp2p/go-libp2p-net"
@@ -120,6 +122,19 @@ func (m *Message_Peer) Addresses() []ma.Multiaddr {
 	return maddrs
 }
 
+// SetValidity records the remaining validity of a provider record on the
+// peer entry, with a resolution of one second.
+func (m *Message_Peer) SetValidity(d time.Duration) {
+	secs := uint64(d / time.Second)
+	m.Validity = &secs
+}
+
+// ValidityDuration returns the remaining validity of a provider record, or
+// zero if the sender did not include it.
+func (m *Message_Peer) ValidityDuration() time.Duration {
+	return time.Duration(m.GetValidity()) * time.Second
+}
+
 // GetClusterLevel gets and adjusts the cluster level on the message.
 // a +/- 1 adjustment is needed to distinguish a valid first level (1) and
 // default "no value" protobuf behavior (0)
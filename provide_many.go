@@ -0,0 +1,272 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	cid "github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// provideBatchSize is the maximum number of keys announced in a single
+// batched ADD_PROVIDER message.
+var provideBatchSize = 512
+
+// provideConcurrency is the number of peers ProvideMany announces keys to at
+// once.
+var provideConcurrency = 20
+
+// noBatchProvideCacheSize is the number of peers we remember as not
+// supporting batched ADD_PROVIDER messages.
+var noBatchProvideCacheSize = 1024
+
+type provideKey struct {
+	c  *cid.Cid
+	id kb.ID
+}
+
+type byKeyspace []provideKey
+
+func (ks byKeyspace) Len() int           { return len(ks) }
+func (ks byKeyspace) Swap(i, j int)      { ks[i], ks[j] = ks[j], ks[i] }
+func (ks byKeyspace) Less(i, j int) bool { return string(ks[i].id) < string(ks[j].id) }
+
+// ProvideMany makes this node announce that it can provide values for all of
+// the given keys. It is equivalent to calling Provide with broadcast for each
+// key, but cheaper for large numbers of keys: keys are announced in keyspace
+// order so that one lookup can serve the keys neighboring its target, and
+// each peer receives its keys in as few messages as possible. Peers that do
+// not understand batched announcements get one message per key.
+func (dht *IpfsDHT) ProvideMany(ctx context.Context, keys []*cid.Cid) error {
+	defer log.EventBegin(ctx, "provideMany", logging.LoggableMap{"keys": len(keys)}).Done()
+	if !dht.startWork() {
+		return ErrClosed
+	}
+	defer dht.doneWork()
+
+	pkeys := make([]provideKey, len(keys))
+	for i, k := range keys {
+		// add self locally
+		dht.providers.AddProvider(ctx, k, dht.self)
+		dht.learnedProvider(k)
+		pkeys[i] = provideKey{c: k, id: kb.ConvertKey(k.KeyString())}
+	}
+	sort.Sort(byKeyspace(pkeys))
+
+	pi, err := dht.provPeerInfo()
+	if err != nil {
+		return err
+	}
+
+	var total, skipped int
+	err = planProvides(ctx, pkeys, dht.closestPeers, func(pending map[peer.ID][]*cid.Cid) {
+		total += len(pending)
+		skipped += dht.sendProviderBatches(ctx, pending, pi)
+	})
+	if err != nil {
+		return err
+	}
+
+	// none of the closest peers could have reached us
+	if total > 0 && skipped == total {
+		return fmt.Errorf("provide many: %s", errNoSharedAddrs)
+	}
+	return nil
+}
+
+// planProvides works out the peers to announce each of pkeys to, which must
+// be sorted in keyspace order, running as few lookups as it can. The keys
+// are handed to send by peer, a few hundred keys at a time.
+func planProvides(ctx context.Context, pkeys []provideKey, lookup func(context.Context, string) ([]peer.ID, error), send func(map[peer.ID][]*cid.Cid)) error {
+	var (
+		target   kb.ID     // key of the last lookup
+		closest  []peer.ID // result of the last lookup
+		coverage int       // see lookupCoverage
+		err      error
+	)
+	pending := make(map[peer.ID][]*cid.Cid)
+	npending := 0
+	for _, k := range pkeys {
+		// neighboring keys mostly go to the same peers, so keys are sent
+		// once enough of them piled up, not after every lookup
+		if npending >= provideBatchSize {
+			send(pending)
+			pending = make(map[peer.ID][]*cid.Cid)
+			npending = 0
+		}
+
+		if target == nil || commonPrefixLen(target, k.id) <= coverage {
+			closest, err = lookup(ctx, k.c.KeyString())
+			if err != nil {
+				return err
+			}
+			target = k.id
+			coverage = lookupCoverage(target, closest)
+		}
+
+		peers := kb.SortClosestPeers(closest, k.id)
+		if len(peers) > KValue {
+			peers = peers[:KValue]
+		}
+		for _, p := range peers {
+			pending[p] = append(pending[p], k.c)
+		}
+		npending++
+	}
+	if npending > 0 {
+		send(pending)
+	}
+	return nil
+}
+
+// closestPeers runs GetClosestPeers to completion.
+func (dht *IpfsDHT) closestPeers(ctx context.Context, key string) ([]peer.ID, error) {
+	pchan, err := dht.GetClosestPeers(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []peer.ID
+	for p := range pchan {
+		peers = append(peers, p)
+	}
+	return peers, ctx.Err()
+}
+
+// lookupCoverage returns the length of the prefix shared by target and all
+// the peers a converged lookup for target found. Keys sharing a longer
+// prefix with target reuse the result. A lookup that found fewer than
+// KValue peers found every peer we could announce to, and covers the whole
+// keyspace.
+//
+// The peers found are the KValue closest to target, so they hold every peer
+// in the half of that prefix's subtree that target and the reusing keys fall
+// into, and those are the closest peers of the keys too. The rest are the
+// peers of the other half closest to target, which are close to the keys as
+// well, but not necessarily the closest.
+func lookupCoverage(target kb.ID, peers []peer.ID) int {
+	if len(peers) < KValue {
+		return -1
+	}
+
+	coverage := len(target) * 8
+	for _, p := range peers {
+		if cpl := commonPrefixLen(target, kb.ConvertPeerID(p)); cpl < coverage {
+			coverage = cpl
+		}
+	}
+	return coverage
+}
+
+// sendProviderBatches announces each peer's keys to it, to up to
+// provideConcurrency peers at once. It returns the number of peers skipped
+// because none of our addresses may be shared with them.
+func (dht *IpfsDHT) sendProviderBatches(ctx context.Context, pending map[peer.ID][]*cid.Cid, pi pstore.PeerInfo) int {
+	peers := make(chan peer.ID)
+	var skipped int32
+	var wg sync.WaitGroup
+	for i := 0; i < provideConcurrency && i < len(pending); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range peers {
+				if err := dht.sendProviderBatch(ctx, p, pending[p], pi); err == errNoSharedAddrs {
+					log.Debugf("not announcing %d keys to %s: %s", len(pending[p]), p, err)
+					atomic.AddInt32(&skipped, 1)
+				}
+			}
+		}()
+	}
+
+	for p := range pending {
+		peers <- p
+	}
+	close(peers)
+	wg.Wait()
+	return int(skipped)
+}
+
+// sendProviderBatch announces keys to p. Failures other than having no
+// addresses to share with p are only logged.
+func (dht *IpfsDHT) sendProviderBatch(ctx context.Context, p peer.ID, keys []*cid.Cid, pi pstore.PeerInfo) error {
+	for len(keys) > 0 {
+		n := provideBatchSize
+		if len(keys) < n {
+			n = len(keys)
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+
+		if !dht.noBatchProvide.Contains(p) && !dht.peerLacksCapability(p, CapBatchProvide) {
+			err := dht.putProviderBatch(ctx, p, batch, pi)
+			if err == nil {
+				continue
+			}
+			if err == errNoSharedAddrs {
+				return err
+			}
+			if err != io.EOF {
+				log.Debugf("putProviderBatch(%s): %s", p, err)
+				return nil
+			}
+
+			// peers that do not understand batches reject the (empty) key
+			// and hang up on us.
+			log.Debugf("%s does not support batched provides", p)
+			dht.noBatchProvide.Add(p, nil)
+		}
+
+		for _, k := range batch {
+			mes, err := dht.makeProvRecord(k, p)
+			if err == errNoSharedAddrs {
+				return err
+			}
+			if err != nil {
+				log.Debug(err)
+				return nil
+			}
+
+			log.Debugf("putProvider(%s, %s)", k, p)
+			if err := dht.sendMessage(ctx, p, mes); err != nil {
+				log.Debug(err)
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// putProviderBatch announces keys to p in a single ADD_PROVIDER message and
+// waits for it to be acknowledged.
+func (dht *IpfsDHT) putProviderBatch(ctx context.Context, p peer.ID, keys []*cid.Cid, pi pstore.PeerInfo) error {
+	provs, err := dht.providerPBPeers(p, pi)
+	if err != nil {
+		return err
+	}
+
+	pmes := pb.NewMessage(pb.Message_ADD_PROVIDER, "", 0)
+	pmes.ProviderPeers = provs
+	pmes.ProviderKeys = make([][]byte, len(keys))
+	for i, k := range keys {
+		pmes.ProviderKeys[i] = k.Bytes()
+	}
+
+	log.Debugf("putProviderBatch(%d keys, %s)", len(keys), p)
+	resp, err := dht.sendRequest(ctx, p, pmes)
+	if err != nil {
+		return err
+	}
+
+	if resp.GetType() != pb.Message_ADD_PROVIDER {
+		return fmt.Errorf("unexpected response to batched provide: %s", resp.GetType())
+	}
+	return nil
+}
@@ -15,6 +15,8 @@ import (
 	goprocess "github.com/jbenet/goprocess"
 	goprocessctx "github.com/jbenet/goprocess/context"
 	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
 	autobatch "github.com/whyrusleeping/autobatch"
 	base32 "github.com/whyrusleeping/base32"
 )
@@ -27,6 +29,10 @@ var lruCacheSize = 256
 var ProvideValidity = time.Hour * 24
 var defaultCleanupInterval = time.Hour
 
+// number of keys a listing of provider records reads before the manager
+// serves other requests again
+var listBatchSize = 64
+
 type ProviderManager struct {
 	// all non channel fields are meant to be accessed only within
 	// the run method
@@ -34,10 +40,13 @@ type ProviderManager struct {
 	lpeer     peer.ID
 	dstore    ds.Datastore
 
-	newprovs chan *addProv
-	getprovs chan *getProv
-	period   time.Duration
-	proc     goprocess.Process
+	newprovs  chan *addProv
+	rmprovs   chan *rmProv
+	getprovs  chan *getProv
+	getinfos  chan *getProvInfos
+	listprovs chan *listProvs
+	period    time.Duration
+	proc      goprocess.Process
 
 	cleanupInterval time.Duration
 }
@@ -45,9 +54,16 @@ type ProviderManager struct {
 type providerSet struct {
 	providers []peer.ID
 	set       map[peer.ID]time.Time
+	addrs     map[peer.ID][]ma.Multiaddr
 }
 
 type addProv struct {
+	k     *cid.Cid
+	val   peer.ID
+	addrs []ma.Multiaddr
+}
+
+type rmProv struct {
 	k   *cid.Cid
 	val peer.ID
 }
@@ -57,10 +73,60 @@ type getProv struct {
 	resp chan []peer.ID
 }
 
+type getProvInfos struct {
+	k    *cid.Cid
+	resp chan []ProviderInfo
+}
+
+// ProviderInfo is a provider for a key, along with the addresses it announced
+// and the time at which its provider record expires.
+type ProviderInfo struct {
+	pstore.PeerInfo
+	Expires time.Time
+}
+
+type listProvs struct {
+	ctx context.Context
+	// only list keys provided by this peer, if set
+	filter peer.ID
+	resp   chan *listProvsResult
+
+	// listing state, kept by the run loop between steps
+	keys func() (*cid.Cid, bool)
+	seen map[string]struct{}
+	out  []ProviderRecord
+}
+
+type listProvsResult struct {
+	records []ProviderRecord
+	err     error
+}
+
+// ProviderRecord describes the providers known for a single key, along with
+// the time each of them last announced it and the addresses they announced.
+type ProviderRecord struct {
+	Key       *cid.Cid
+	Providers map[peer.ID]time.Time
+	Addrs     map[peer.ID][]ma.Multiaddr
+}
+
+// ProviderStats summarizes the contents of a ProviderManager.
+type ProviderStats struct {
+	// Keys is the number of keys with at least one provider.
+	Keys int
+	// Records is the total number of (key, provider) pairs.
+	Records int
+	// LocalKeys is the number of keys provided by the local peer.
+	LocalKeys int
+}
+
 func NewProviderManager(ctx context.Context, local peer.ID, dstore ds.Batching) *ProviderManager {
 	pm := new(ProviderManager)
 	pm.getprovs = make(chan *getProv)
+	pm.getinfos = make(chan *getProvInfos)
+	pm.listprovs = make(chan *listProvs)
 	pm.newprovs = make(chan *addProv)
+	pm.rmprovs = make(chan *rmProv)
 	pm.dstore = autobatch.NewAutoBatching(dstore, batchBufferSize)
 	cache, err := lru.New(lruCacheSize)
 	if err != nil {
@@ -93,6 +159,25 @@ func (pm *ProviderManager) providersForKey(k *cid.Cid) ([]peer.ID, error) {
 	return pset.providers, nil
 }
 
+func (pm *ProviderManager) providerInfosForKey(k *cid.Cid) ([]ProviderInfo, error) {
+	pset, err := pm.getProvSet(k)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]ProviderInfo, 0, len(pset.providers))
+	for _, p := range pset.providers {
+		infos = append(infos, ProviderInfo{
+			PeerInfo: pstore.PeerInfo{
+				ID:    p,
+				Addrs: pset.addrs[p],
+			},
+			Expires: pset.set[p].Add(ProvideValidity),
+		})
+	}
+	return infos, nil
+}
+
 func (pm *ProviderManager) getProvSet(k *cid.Cid) (*providerSet, error) {
 	cached, ok := pm.providers.Get(k.KeyString())
 	if ok {
@@ -138,30 +223,54 @@ func loadProvSet(dstore ds.Datastore, k *cid.Cid) (*providerSet, error) {
 
 		pid := peer.ID(decstr)
 
-		t, err := readTimeValue(e.Value)
+		t, addrs, err := readProviderEntry(e.Value)
 		if err != nil {
 			log.Warning("parsing providers record from disk: ", err)
 			continue
 		}
 
 		out.setVal(pid, t)
+		out.setAddrs(pid, addrs)
 	}
 
 	return out, nil
 }
 
-func readTimeValue(i interface{}) (time.Time, error) {
+// readProviderEntry decodes a provider entry written by writeProviderEntry.
+// Entries written before addresses were stored only hold the time.
+func readProviderEntry(i interface{}) (time.Time, []ma.Multiaddr, error) {
 	data, ok := i.([]byte)
 	if !ok {
-		return time.Time{}, fmt.Errorf("data was not a []byte")
+		return time.Time{}, nil, fmt.Errorf("data was not a []byte")
+	}
+
+	nsec, n := binary.Varint(data)
+	if n <= 0 {
+		return time.Time{}, nil, fmt.Errorf("invalid time value")
 	}
+	t := time.Unix(0, nsec)
+
+	var addrs []ma.Multiaddr
+	for data = data[n:]; len(data) > 0; {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			log.Warning("truncated address in provider record")
+			break
+		}
 
-	nsec, _ := binary.Varint(data)
+		maddr, err := ma.NewMultiaddrBytes(data[n : n+int(l)])
+		data = data[n+int(l):]
+		if err != nil {
+			log.Warning("invalid address in provider record: ", err)
+			continue
+		}
+		addrs = append(addrs, maddr)
+	}
 
-	return time.Unix(0, nsec), nil
+	return t, addrs, nil
 }
 
-func (pm *ProviderManager) addProv(k *cid.Cid, p peer.ID) error {
+func (pm *ProviderManager) addProv(k *cid.Cid, p peer.ID, addrs []ma.Multiaddr) error {
 	iprovs, ok := pm.providers.Get(k.KeyString())
 	if !ok {
 		stored, err := loadProvSet(pm.dstore, k)
@@ -175,16 +284,52 @@ func (pm *ProviderManager) addProv(k *cid.Cid, p peer.ID) error {
 	now := time.Now()
 	provs.setVal(p, now)
 
-	return writeProviderEntry(pm.dstore, k, p, now)
+	// keep the addresses we already know of if the provider did not
+	// announce any this time.
+	if len(addrs) > 0 {
+		provs.setAddrs(p, addrs)
+	}
+
+	return writeProviderEntry(pm.dstore, k, p, now, provs.addrs[p])
 }
 
-func writeProviderEntry(dstore ds.Datastore, k *cid.Cid, p peer.ID, t time.Time) error {
-	dsk := mkProvKey(k) + "/" + base32.RawStdEncoding.EncodeToString([]byte(p))
+func mkProvEntryKey(k *cid.Cid, p peer.ID) ds.Key {
+	return ds.NewKey(mkProvKey(k) + "/" + base32.RawStdEncoding.EncodeToString([]byte(p)))
+}
 
-	buf := make([]byte, 16)
+// writeProviderEntry stores a provider entry as the varint encoded time it
+// was received, followed by the provider's addresses, each prefixed with its
+// uvarint encoded length.
+func writeProviderEntry(dstore ds.Datastore, k *cid.Cid, p peer.ID, t time.Time, addrs []ma.Multiaddr) error {
+	buf := make([]byte, binary.MaxVarintLen64)
 	n := binary.PutVarint(buf, t.UnixNano())
+	val := append([]byte(nil), buf[:n]...)
 
-	return dstore.Put(ds.NewKey(dsk), buf[:n])
+	for _, maddr := range addrs {
+		b := maddr.Bytes()
+		n := binary.PutUvarint(buf, uint64(len(b)))
+		val = append(val, buf[:n]...)
+		val = append(val, b...)
+	}
+
+	return dstore.Put(mkProvEntryKey(k, p), val)
+}
+
+func (pm *ProviderManager) rmProv(k *cid.Cid, p peer.ID) error {
+	provs, err := pm.getProvSet(k)
+	if err != nil {
+		return err
+	}
+
+	if !provs.remove(p) {
+		return nil
+	}
+
+	if len(provs.providers) == 0 {
+		pm.providers.Remove(k.KeyString())
+	}
+
+	return pm.dstore.Delete(mkProvEntryKey(k, p))
 }
 
 func (pm *ProviderManager) deleteProvSet(k *cid.Cid) error {
@@ -248,15 +393,110 @@ func (pm *ProviderManager) getProvKeys() (func() (*cid.Cid, bool), error) {
 	return iter, nil
 }
 
+// listProvRecords reads the next listBatchSize keys of a listing of the
+// provider records in the datastore, and reports whether the listing is
+// done. Only unexpired records are listed, and only keys provided by the
+// filter peer if it is set. Records are read around the LRU cache so that
+// listing does not evict hot entries.
+func (pm *ProviderManager) listProvRecords(lp *listProvs) bool {
+	if lp.keys == nil {
+		keys, err := pm.getProvKeys()
+		if err != nil {
+			lp.resp <- &listProvsResult{err: err}
+			return true
+		}
+		lp.keys = keys
+		lp.seen = make(map[string]struct{})
+	}
+
+	// the requester gave up
+	if err := lp.ctx.Err(); err != nil {
+		lp.resp <- &listProvsResult{err: err}
+		return true
+	}
+
+	now := time.Now()
+	for i := 0; i < listBatchSize; i++ {
+		k, ok := lp.keys()
+		if !ok {
+			lp.resp <- &listProvsResult{records: lp.out}
+			return true
+		}
+
+		// getProvKeys yields a key once per provider entry
+		if _, found := lp.seen[k.KeyString()]; found {
+			continue
+		}
+		lp.seen[k.KeyString()] = struct{}{}
+
+		var provs *providerSet
+		if cached, ok := pm.providers.Peek(k.KeyString()); ok {
+			provs = cached.(*providerSet)
+		} else {
+			var err error
+			provs, err = loadProvSet(pm.dstore, k)
+			if err != nil {
+				log.Error("error loading provider set: ", err)
+				continue
+			}
+		}
+
+		rec := ProviderRecord{
+			Key:       k,
+			Providers: make(map[peer.ID]time.Time, len(provs.set)),
+			Addrs:     make(map[peer.ID][]ma.Multiaddr, len(provs.addrs)),
+		}
+		// expired records linger until the next cleanup
+		for p, t := range provs.set {
+			if now.Sub(t) > ProvideValidity {
+				continue
+			}
+			rec.Providers[p] = t
+			if addrs, ok := provs.addrs[p]; ok {
+				rec.Addrs[p] = addrs
+			}
+		}
+
+		if len(rec.Providers) == 0 {
+			continue
+		}
+		if _, found := rec.Providers[lp.filter]; lp.filter != "" && !found {
+			continue
+		}
+		lp.out = append(lp.out, rec)
+	}
+	return false
+}
+
 func (pm *ProviderManager) run() {
 	tick := time.NewTicker(pm.cleanupInterval)
+
+	// a listing of provider records is done in steps, in between other
+	// requests. While one is in progress, step is ready and no other
+	// listing is taken on.
+	var listing *listProvs
+	ready := make(chan struct{})
+	close(ready)
+
 	for {
+		listprovs, step := pm.listprovs, ready
+		if listing != nil {
+			listprovs = nil
+		} else {
+			step = nil
+		}
+
 		select {
 		case np := <-pm.newprovs:
-			err := pm.addProv(np.k, np.val)
+			err := pm.addProv(np.k, np.val, np.addrs)
 			if err != nil {
 				log.Error("error adding new providers: ", err)
 			}
+		case rp := <-pm.rmprovs:
+			err := pm.rmProv(rp.k, rp.val)
+			if err != nil {
+				log.Error("error removing provider: ", err)
+			}
 		case gp := <-pm.getprovs:
 			provs, err := pm.providersForKey(gp.k)
 			if err != nil && err != ds.ErrNotFound {
@@ -264,6 +504,19 @@ func (pm *ProviderManager) run() {
 			}
 
 			gp.resp <- provs
+		case gi := <-pm.getinfos:
+			infos, err := pm.providerInfosForKey(gi.k)
+			if err != nil && err != ds.ErrNotFound {
+				log.Error("error reading providers: ", err)
+			}
+
+			gi.resp <- infos
+		case lp := <-listprovs:
+			listing = lp
+		case <-step:
+			if pm.listProvRecords(listing) {
+				listing = nil
+			}
 		case <-tick.C:
 			keys, err := pm.getProvKeys()
 			if err != nil {
@@ -285,6 +538,7 @@ func (pm *ProviderManager) run() {
 				for p, t := range provs.set {
 					if time.Now().Sub(t) > ProvideValidity {
 						delete(provs.set, p)
+						delete(provs.addrs, p)
 					} else {
 						filtered = append(filtered, p)
 					}
@@ -316,6 +570,34 @@ func (pm *ProviderManager) AddProvider(ctx context.Context, k *cid.Cid, val peer
 	}
 }
 
+// AddProviderInfo is like AddProvider, but also stores the addresses the
+// provider announced, so they can be handed out along with the record even
+// after they have expired from the peerstore.
+func (pm *ProviderManager) AddProviderInfo(ctx context.Context, k *cid.Cid, pi pstore.PeerInfo) {
+	prov := &addProv{
+		k:     k,
+		val:   pi.ID,
+		addrs: pi.Addrs,
+	}
+	select {
+	case pm.newprovs <- prov:
+	case <-ctx.Done():
+	}
+}
+
+// RemoveProvider removes p from the set of providers for k. Unlike expiry,
+// the removal takes effect immediately, both in memory and in the datastore.
+func (pm *ProviderManager) RemoveProvider(ctx context.Context, k *cid.Cid, p peer.ID) {
+	prov := &rmProv{
+		k:   k,
+		val: p,
+	}
+	select {
+	case pm.rmprovs <- prov:
+	case <-ctx.Done():
+	}
+}
+
 func (pm *ProviderManager) GetProviders(ctx context.Context, k *cid.Cid) []peer.ID {
 	gp := &getProv{
 		k:    k,
@@ -334,9 +616,82 @@ func (pm *ProviderManager) GetProviders(ctx context.Context, k *cid.Cid) []peer.
 	}
 }
 
+// ProviderRecords returns all unexpired provider records stored by the
+// manager. The records are read by the manager's own goroutine, a few keys
+// at a time in between other operations, so it is safe to call while
+// providers are being added or expired. Records changed while the listing
+// is in progress may be listed either way.
+func (pm *ProviderManager) ProviderRecords(ctx context.Context) ([]ProviderRecord, error) {
+	return pm.listProviderRecords(ctx, "")
+}
+
+// LocalProviderRecords is like ProviderRecords, but only returns records for
+// keys provided by the local peer.
+func (pm *ProviderManager) LocalProviderRecords(ctx context.Context) ([]ProviderRecord, error) {
+	return pm.listProviderRecords(ctx, pm.lpeer)
+}
+
+// Stats counts the keys and provider records stored by the manager.
+func (pm *ProviderManager) Stats(ctx context.Context) (ProviderStats, error) {
+	var stats ProviderStats
+	recs, err := pm.ProviderRecords(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	for _, rec := range recs {
+		stats.Keys++
+		stats.Records += len(rec.Providers)
+		if _, ok := rec.Providers[pm.lpeer]; ok {
+			stats.LocalKeys++
+		}
+	}
+	return stats, nil
+}
+
+func (pm *ProviderManager) listProviderRecords(ctx context.Context, filter peer.ID) ([]ProviderRecord, error) {
+	lp := &listProvs{
+		ctx:    ctx,
+		filter: filter,
+		resp:   make(chan *listProvsResult, 1), // buffered to prevent sender from blocking
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case pm.listprovs <- lp:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-lp.resp:
+		return res.records, res.err
+	}
+}
+
+// GetProviderInfos is like GetProviders, but also returns the stored
+// addresses of each provider and the time its record expires.
+func (pm *ProviderManager) GetProviderInfos(ctx context.Context, k *cid.Cid) []ProviderInfo {
+	gi := &getProvInfos{
+		k:    k,
+		resp: make(chan []ProviderInfo, 1), // buffered to prevent sender from blocking
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case pm.getinfos <- gi:
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case infos := <-gi.resp:
+		return infos
+	}
+}
+
 func newProviderSet() *providerSet {
 	return &providerSet{
-		set: make(map[peer.ID]time.Time),
+		set:   make(map[peer.ID]time.Time),
+		addrs: make(map[peer.ID][]ma.Multiaddr),
 	}
 }
 
@@ -352,3 +707,30 @@ func (ps *providerSet) setVal(p peer.ID, t time.Time) {
 
 	ps.set[p] = t
 }
+
+func (ps *providerSet) setAddrs(p peer.ID, addrs []ma.Multiaddr) {
+	if len(addrs) == 0 {
+		return
+	}
+	ps.addrs[p] = addrs
+}
+
+// remove deletes p from the set and reports whether it was present. The
+// providers slice is replaced rather than modified in place, as it may have
+// been handed out to callers of GetProviders.
+func (ps *providerSet) remove(p peer.ID) bool {
+	if _, found := ps.set[p]; !found {
+		return false
+	}
+	delete(ps.set, p)
+	delete(ps.addrs, p)
+
+	filtered := make([]peer.ID, 0, len(ps.providers))
+	for _, pp := range ps.providers {
+		if pp != p {
+			filtered = append(filtered, pp)
+		}
+	}
+	ps.providers = filtered
+	return true
+}
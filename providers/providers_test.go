@@ -12,6 +12,8 @@ import (
 	ds "github.com/ipfs/go-datastore"
 	u "github.com/ipfs/go-ipfs-util"
 	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
 	//
 	// used by TestLargeProvidersSet: do not remove
 	// lds "github.com/ipfs/go-ds-leveldb"
@@ -30,6 +32,117 @@ func TestProviderManager(t *testing.T) {
 	p.proc.Close()
 }
 
+func TestProviderRemove(t *testing.T) {
+	ctx := context.Background()
+	mid := peer.ID("testing")
+	p := NewProviderManager(ctx, mid, ds.NewMapDatastore())
+	defer p.proc.Close()
+
+	a := cid.NewCidV0(u.Hash([]byte("test")))
+	p1, p2 := peer.ID("a"), peer.ID("b")
+	p.AddProvider(ctx, a, p1)
+	p.AddProvider(ctx, a, p2)
+
+	p.RemoveProvider(ctx, a, p1)
+	resp := p.GetProviders(ctx, a)
+	if len(resp) != 1 || resp[0] != p2 {
+		t.Fatalf("expected only %s to remain, got %s", p2, resp)
+	}
+
+	// removing from the cache must also remove it from the datastore
+	p.providers.Purge()
+	resp = p.GetProviders(ctx, a)
+	if len(resp) != 1 || resp[0] != p2 {
+		t.Fatalf("expected only %s to remain after reload, got %s", p2, resp)
+	}
+
+	// removing an unknown provider is a no-op
+	p.RemoveProvider(ctx, a, peer.ID("c"))
+	p.RemoveProvider(ctx, a, p2)
+	if resp := p.GetProviders(ctx, a); len(resp) != 0 {
+		t.Fatal("expected no providers left, got: ", resp)
+	}
+}
+
+func TestProviderRecords(t *testing.T) {
+	old, batch := lruCacheSize, listBatchSize
+	lruCacheSize = 2
+	listBatchSize = 3
+	defer func() { lruCacheSize, listBatchSize = old, batch }()
+
+	ctx := context.Background()
+	mid := peer.ID("testing")
+	p := NewProviderManager(ctx, mid, ds.NewMapDatastore())
+	defer p.proc.Close()
+
+	friend := peer.ID("friend")
+	var cids []*cid.Cid
+	for i := 0; i < 10; i++ {
+		c := cid.NewCidV0(u.Hash([]byte(fmt.Sprint(i))))
+		cids = append(cids, c)
+		p.AddProvider(ctx, c, friend)
+		if i%2 == 0 {
+			p.AddProvider(ctx, c, mid)
+		}
+	}
+
+	recs, err := p.ProviderRecords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != len(cids) {
+		t.Fatalf("expected %d records, got %d", len(cids), len(recs))
+	}
+	for _, rec := range recs {
+		if _, ok := rec.Providers[friend]; !ok {
+			t.Fatalf("missing provider for %s", rec.Key)
+		}
+	}
+
+	local, err := p.LocalProviderRecords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(local) != 5 {
+		t.Fatalf("expected 5 local records, got %d", len(local))
+	}
+
+	stats, err := p.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 10 || stats.Records != 15 || stats.LocalKeys != 5 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestProviderRecordsExpire(t *testing.T) {
+	pval := ProvideValidity
+	ProvideValidity = time.Second / 2
+	defer func() { ProvideValidity = pval }()
+
+	ctx := context.Background()
+	mid := peer.ID("testing")
+	p := NewProviderManager(ctx, mid, ds.NewMapDatastore())
+	defer p.proc.Close()
+
+	old := cid.NewCidV0(u.Hash([]byte("old")))
+	p.AddProvider(ctx, old, peer.ID("a"))
+	time.Sleep(time.Second)
+
+	fresh := cid.NewCidV0(u.Hash([]byte("fresh")))
+	p.AddProvider(ctx, fresh, peer.ID("b"))
+
+	// the cleanup has not run yet, but the expired record is not listed
+	recs, err := p.ProviderRecords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || !recs[0].Key.Equals(fresh) {
+		t.Fatalf("expected only the fresh record, got %v", recs)
+	}
+}
+
 func TestProvidersDatastore(t *testing.T) {
 	old := lruCacheSize
 	lruCacheSize = 10
@@ -68,12 +181,12 @@ func TestProvidersSerialization(t *testing.T) {
 	pt1 := time.Now()
 	pt2 := pt1.Add(time.Hour)
 
-	err := writeProviderEntry(dstore, k, p1, pt1)
+	err := writeProviderEntry(dstore, k, p1, pt1, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = writeProviderEntry(dstore, k, p2, pt2)
+	err = writeProviderEntry(dstore, k, p2, pt2, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -102,6 +215,83 @@ func TestProvidersSerialization(t *testing.T) {
 	}
 }
 
+func mustAddr(t *testing.T, s string) ma.Multiaddr {
+	maddr, err := ma.NewMultiaddr(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return maddr
+}
+
+func TestProviderAddrsSerialization(t *testing.T) {
+	dstore := ds.NewMapDatastore()
+
+	k := cid.NewCidV0(u.Hash(([]byte("my key!"))))
+	p1 := peer.ID("peer one")
+	addrs := []ma.Multiaddr{
+		mustAddr(t, "/ip4/1.2.3.4/tcp/4001"),
+		mustAddr(t, "/ip6/::1/tcp/4002"),
+	}
+	pt1 := time.Now()
+
+	err := writeProviderEntry(dstore, k, p1, pt1, addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pset, err := loadProvSet(dstore, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pt1 != pset.set[p1] {
+		t.Fatal("time wasnt serialized correctly")
+	}
+
+	laddrs := pset.addrs[p1]
+	if len(laddrs) != len(addrs) {
+		t.Fatalf("expected %d addrs, got %d", len(addrs), len(laddrs))
+	}
+	for i := range addrs {
+		if !addrs[i].Equal(laddrs[i]) {
+			t.Fatalf("addr %d: expected %s, got %s", i, addrs[i], laddrs[i])
+		}
+	}
+}
+
+func TestProviderInfos(t *testing.T) {
+	ctx := context.Background()
+	mid := peer.ID("testing")
+	p := NewProviderManager(ctx, mid, ds.NewMapDatastore())
+	defer p.proc.Close()
+
+	a := cid.NewCidV0(u.Hash([]byte("test")))
+	pi := pstore.PeerInfo{
+		ID:    peer.ID("friend"),
+		Addrs: []ma.Multiaddr{mustAddr(t, "/ip4/1.2.3.4/tcp/4001")},
+	}
+	p.AddProviderInfo(ctx, a, pi)
+
+	// announcing again without addresses keeps the known ones
+	p.AddProvider(ctx, a, pi.ID)
+
+	// force a reload from the datastore
+	p.providers.Purge()
+
+	infos := p.GetProviderInfos(ctx, a)
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 provider, got %d", len(infos))
+	}
+	if infos[0].ID != pi.ID || len(infos[0].Addrs) != 1 || !infos[0].Addrs[0].Equal(pi.Addrs[0]) {
+		t.Fatalf("unexpected provider info: %v", infos[0])
+	}
+
+	remaining := infos[0].Expires.Sub(time.Now())
+	if remaining <= 0 || remaining > ProvideValidity {
+		t.Fatalf("unexpected expiry: %s remaining", remaining)
+	}
+}
+
 func TestProvidesExpire(t *testing.T) {
 	pval := ProvideValidity
 	cleanup := defaultCleanupInterval
@@ -72,6 +72,7 @@ type dhtQueryRunner struct {
 	query          *dhtQuery        // query to run
 	peersSeen      *pset.PeerSet    // all peers queried. prevent querying same peer 2x
 	peersToQuery   *queue.ChanQueue // peers remaining to be queried
+	peersPutOff    *queue.ChanQueue // peers others could not reach, queried last
 	peersRemaining todoctr.Counter  // peersToQuery + currently processing
 
 	result *dhtQueryResult // query result
@@ -92,6 +93,7 @@ func newQueryRunner(q *dhtQuery) *dhtQueryRunner {
 	return &dhtQueryRunner{
 		query:          q,
 		peersToQuery:   queue.NewChanQueue(ctx, queue.NewXORDistancePQ(string(q.key))),
+		peersPutOff:    queue.NewChanQueue(ctx, queue.NewXORDistancePQ(string(q.key))),
 		peersRemaining: todoctr.NewSyncCounter(),
 		peersSeen:      pset.New(),
 		rateLimit:      make(chan struct{}, q.concurrency),
@@ -108,6 +110,9 @@ func (r *dhtQueryRunner) Run(ctx context.Context, peers []peer.ID) (*dhtQueryRes
 		return nil, nil
 	}
 
+	// this lookup refreshes the bucket its key falls into
+	r.query.dht.recordLookup(r.query.key)
+
 	// setup concurrency rate limiting
 	for i := 0; i < r.query.concurrency; i++ {
 		r.rateLimit <- struct{}{}
@@ -169,6 +174,11 @@ func (r *dhtQueryRunner) addPeerToQuery(next peer.ID) {
 		return
 	}
 
+	if !r.query.dht.allowPeer(next) {
+		r.log.Debugf("addPeerToQuery skip filtered peer %s", next)
+		return
+	}
+
 	if !r.peersSeen.TryAdd(next) {
 		return
 	}
@@ -178,11 +188,39 @@ func (r *dhtQueryRunner) addPeerToQuery(next peer.ID) {
 		ID:   next,
 	})
 
+	// other peers could not reach this one, give the rest a head start.
+	q := r.peersToQuery
+	if len(r.query.dht.host.Network().ConnsToPeer(next)) == 0 && r.query.dht.dials.reportedUnreachable(next) {
+		r.log.Debugf("addPeerToQuery: %s reported unreachable, putting it off", next)
+		q = r.peersPutOff
+	}
+
 	r.peersRemaining.Increment(1)
 	select {
-	case r.peersToQuery.EnqChan <- next:
+	case q.EnqChan <- next:
+	case <-r.proc.Closing():
+	}
+}
+
+// nextPeer waits for the next peer to query. Peers that were put off are only
+// queried while no other peer is waiting. It returns false once the query is
+// over.
+func (r *dhtQueryRunner) nextPeer() (peer.ID, bool) {
+	select {
+	case p, more := <-r.peersToQuery.DeqChan:
+		return p, more
+	default:
+	}
+
+	select {
+	case p, more := <-r.peersToQuery.DeqChan:
+		return p, more
+	case p, more := <-r.peersPutOff.DeqChan:
+		return p, more
 	case <-r.proc.Closing():
+	case <-r.peersRemaining.Done():
 	}
+	return "", false
 }
 
 func (r *dhtQueryRunner) spawnWorkers(proc process.Process) {
@@ -196,22 +234,16 @@ func (r *dhtQueryRunner) spawnWorkers(proc process.Process) {
 			return
 
 		case <-r.rateLimit:
-			select {
-			case p, more := <-r.peersToQuery.DeqChan:
-				if !more {
-					return // channel closed.
-				}
-
-				// do it as a child func to make sure Run exits
-				// ONLY AFTER spawn workers has exited.
-				proc.Go(func(proc process.Process) {
-					r.queryPeer(proc, p)
-				})
-			case <-r.proc.Closing():
-				return
-			case <-r.peersRemaining.Done():
-				return
+			p, more := r.nextPeer()
+			if !more {
+				return // channel closed, or the query is over.
 			}
+
+			// do it as a child func to make sure Run exits
+			// ONLY AFTER spawn workers has exited.
+			proc.Go(func(proc process.Process) {
+				r.queryPeer(proc, p)
+			})
 		}
 	}
 }
@@ -256,10 +288,17 @@ func (r *dhtQueryRunner) queryPeer(proc process.Process, p peer.ID) {
 			r.Lock()
 			r.errs = append(r.errs, err)
 			r.Unlock()
+
+			// only count it if the dial failed on its own, not because we gave up
+			if ctx.Err() == nil {
+				r.query.dht.dials.dialFailed(p)
+				r.query.dht.peerUnreachable(p)
+			}
 			<-r.rateLimit // need to grab it again, as we deferred.
 			return
 		}
 		<-r.rateLimit // need to grab it again, as we deferred.
+		r.query.dht.dials.dialSucceeded(p)
 		log.Debugf("connected. dial success.")
 	}
 
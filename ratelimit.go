@@ -0,0 +1,185 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// RateLimit is a token bucket: a peer may send Rate requests per second on
+// average, in bursts of up to Burst requests.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitConfig limits the requests we serve. Requests over a limit are
+// answered with a BUSY error.
+type RateLimitConfig struct {
+	// PerPeer limits the requests of each type a single peer may send us.
+	// Types without an entry are not limited.
+	PerPeer map[pb.Message_MessageType]RateLimit
+
+	// MaxConcurrentHandlers caps the number of requests being handled at
+	// once, across all peers. Zero disables the cap.
+	MaxConcurrentHandlers int
+}
+
+// DefaultRateLimitConfig is used by newly constructed DHTs. The limits are
+// meant to only catch misbehaving peers: well-behaved ones ping us for
+// eviction checks and capabilities, and run many lookups at once. Single
+// ADD_PROVIDER announcements are not limited, as they are not answered and
+// their sender would never learn they were dropped.
+var DefaultRateLimitConfig = RateLimitConfig{
+	PerPeer: map[pb.Message_MessageType]RateLimit{
+		pb.Message_PING:          {Rate: 20, Burst: 100},
+		pb.Message_FIND_NODE:     {Rate: 200, Burst: 1000},
+		pb.Message_GET_VALUE:     {Rate: 200, Burst: 1000},
+		pb.Message_GET_PROVIDERS: {Rate: 200, Burst: 1000},
+		pb.Message_PUT_VALUE:     {Rate: 50, Burst: 200},
+	},
+	MaxConcurrentHandlers: 256,
+}
+
+// RateLimitStats counts the requests turned down for being over the limits.
+type RateLimitStats struct {
+	Rejected uint64 // answered with a BUSY error
+	Dropped  uint64 // not answered, as the sender expected no response
+}
+
+// number of peers we keep token buckets for. A peer that drops out of the
+// cache starts over with full buckets.
+const rateLimitCacheSize = 4096
+
+var (
+	errRateLimited = &handlerError{code: pb.Message_BUSY, msg: "request rate limit exceeded"}
+	errTooBusy     = &handlerError{code: pb.Message_BUSY, msg: "too many concurrent requests"}
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time passed since the last call, and takes
+// a token from it if there is one.
+func (b *tokenBucket) take(lim RateLimit, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * lim.Rate
+	if b.tokens > float64(lim.Burst) {
+		b.tokens = float64(lim.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter decides which inbound requests we serve.
+type rateLimiter struct {
+	lk      sync.Mutex
+	cfg     RateLimitConfig
+	buckets *lru.Cache      // peer.ID -> map[pb.Message_MessageType]*tokenBucket
+	running chan struct{}   // handler slots, nil if not capped
+	stats   *RateLimitStats // updated atomically
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	buckets, err := lru.New(rateLimitCacheSize)
+	if err != nil {
+		panic(err) //only happens if negative value is passed to lru constructor
+	}
+	rl := &rateLimiter{buckets: buckets, stats: new(RateLimitStats)}
+	rl.setConfig(cfg)
+	return rl
+}
+
+func (rl *rateLimiter) setConfig(cfg RateLimitConfig) {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+
+	rl.cfg = cfg
+	rl.buckets.Purge()
+	rl.running = nil
+	if cfg.MaxConcurrentHandlers > 0 {
+		rl.running = make(chan struct{}, cfg.MaxConcurrentHandlers)
+	}
+}
+
+// admit decides whether to handle a request of type t from p. If so, the
+// returned func must be called once the request has been handled.
+func (rl *rateLimiter) admit(p peer.ID, t pb.Message_MessageType) (func(), error) {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+
+	if lim, ok := rl.cfg.PerPeer[t]; ok {
+		var peerBuckets map[pb.Message_MessageType]*tokenBucket
+		if v, ok := rl.buckets.Get(p); ok {
+			peerBuckets = v.(map[pb.Message_MessageType]*tokenBucket)
+		} else {
+			peerBuckets = make(map[pb.Message_MessageType]*tokenBucket)
+			rl.buckets.Add(p, peerBuckets)
+		}
+
+		now := time.Now()
+		b, ok := peerBuckets[t]
+		if !ok {
+			b = &tokenBucket{tokens: float64(lim.Burst), last: now}
+			peerBuckets[t] = b
+		}
+		if !b.take(lim, now) {
+			return nil, errRateLimited
+		}
+	}
+
+	// keep the channel we took the slot from, the config may change before
+	// the handler is done.
+	running := rl.running
+	if running == nil {
+		return func() {}, nil
+	}
+	select {
+	case running <- struct{}{}:
+		return func() { <-running }, nil
+	default:
+		return nil, errTooBusy
+	}
+}
+
+// turnedDown counts a request that was not admitted.
+func (rl *rateLimiter) turnedDown(pmes *pb.Message) {
+	if expectsResponse(pmes) {
+		atomic.AddUint64(&rl.stats.Rejected, 1)
+	} else {
+		atomic.AddUint64(&rl.stats.Dropped, 1)
+	}
+}
+
+// SetRateLimitConfig changes the limits on the requests we serve. Token
+// buckets start over full.
+func (dht *IpfsDHT) SetRateLimitConfig(cfg RateLimitConfig) {
+	dht.limiter.setConfig(cfg)
+}
+
+// RateLimitStats returns the number of requests turned down so far for
+// being over the limits.
+func (dht *IpfsDHT) RateLimitStats() RateLimitStats {
+	return RateLimitStats{
+		Rejected: atomic.LoadUint64(&dht.limiter.stats.Rejected),
+		Dropped:  atomic.LoadUint64(&dht.limiter.stats.Dropped),
+	}
+}
+
+// rejectHandler returns a handler that turns down every request with err.
+func rejectHandler(err error) dhtHandler {
+	return func(context.Context, peer.ID, *pb.Message) (*pb.Message, error) {
+		return nil, err
+	}
+}
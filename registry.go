@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"context"
+	"errors"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// MessageHandler handles inbound messages of a registered type. The response
+// is sent back to the requester, unless it is nil. Messages sent with
+// SendMessage carry no request ID and expect no response.
+//
+// A handler may return a *RemoteError to reject a request with a given code
+// and message; other errors are reported to the requester as INTERNAL_ERROR.
+type MessageHandler func(ctx context.Context, from peer.ID, pmes *pb.Message) (*pb.Message, error)
+
+var (
+	// ErrBuiltinMessageType is returned when registering a handler for one of
+	// the message types the DHT handles itself.
+	ErrBuiltinMessageType = errors.New("message type is handled by the dht")
+
+	// ErrHandlerExists is returned when registering a handler for a message
+	// type that already has one.
+	ErrHandlerExists = errors.New("message type already has a handler")
+)
+
+// builtinMessageType reports whether t is one of the types handled by the
+// DHT itself.
+func builtinMessageType(t pb.Message_MessageType) bool {
+	_, ok := pb.Message_MessageType_name[int32(t)]
+	return ok
+}
+
+// RegisterHandler makes the DHT hand inbound messages of type t to h. Inbound
+// messages are subject to the same limits and deadlines as the DHT's own.
+func (dht *IpfsDHT) RegisterHandler(t pb.Message_MessageType, h MessageHandler) error {
+	if builtinMessageType(t) {
+		return ErrBuiltinMessageType
+	}
+
+	dht.hlk.Lock()
+	defer dht.hlk.Unlock()
+	if _, ok := dht.handlers[t]; ok {
+		return ErrHandlerExists
+	}
+	dht.handlers[t] = h
+	return nil
+}
+
+// UnregisterHandler removes the handler for message type t, if any.
+func (dht *IpfsDHT) UnregisterHandler(t pb.Message_MessageType) {
+	dht.hlk.Lock()
+	defer dht.hlk.Unlock()
+	delete(dht.handlers, t)
+}
+
+// registeredHandler returns the handler registered for t, or nil.
+func (dht *IpfsDHT) registeredHandler(t pb.Message_MessageType) dhtHandler {
+	dht.hlk.RLock()
+	defer dht.hlk.RUnlock()
+	if h, ok := dht.handlers[t]; ok {
+		return dhtHandler(h)
+	}
+	return nil
+}
+
+// SendRequest sends pmes to p over the DHT's streams, and waits for the
+// response. A request the peer rejects fails with a *RemoteError.
+func (dht *IpfsDHT) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	return dht.sendRequest(ctx, p, pmes)
+}
+
+// SendMessage sends pmes to p over the DHT's streams, without waiting for a
+// response.
+func (dht *IpfsDHT) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	return dht.sendMessage(ctx, p, pmes)
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	cid "github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	providers "github.com/libp2p/go-libp2p-kad-dht/providers"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	inet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
@@ -35,6 +37,11 @@ var asyncQueryBuffer = 10
 // This is the top level "Store" operation of the DHT
 func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte) error {
 	log.Debugf("PutValue %s", key)
+	if !dht.startWork() {
+		return ErrClosed
+	}
+	defer dht.doneWork()
+
 	sk, err := dht.getOwnPrivateKey()
 	if err != nil {
 		return err
@@ -122,7 +129,8 @@ func (dht *IpfsDHT) GetValue(ctx context.Context, key string) ([]byte, error) {
 	for _, v := range vals {
 		// if someone sent us a different 'less-valid' record, lets correct them
 		if !bytes.Equal(v.Val, best) {
-			go func(v routing.RecvdVal) {
+			v := v
+			dht.goTracked(func() {
 				if v.From == dht.self {
 					err := dht.putLocal(key, fixupRec)
 					if err != nil {
@@ -136,7 +144,7 @@ func (dht *IpfsDHT) GetValue(ctx context.Context, key string) ([]byte, error) {
 				if err != nil {
 					log.Error("Error correcting DHT entry: ", err)
 				}
-			}(v)
+			})
 		}
 	}
 
@@ -243,9 +251,14 @@ func (dht *IpfsDHT) GetValues(ctx context.Context, key string, nvals int) ([]rou
 // Provide makes this node announce that it can provide a value for the given key
 func (dht *IpfsDHT) Provide(ctx context.Context, key *cid.Cid, brdcst bool) error {
 	defer log.EventBegin(ctx, "provide", key, logging.LoggableMap{"broadcast": brdcst}).Done()
+	if !dht.startWork() {
+		return ErrClosed
+	}
+	defer dht.doneWork()
 
 	// add self locally
 	dht.providers.AddProvider(ctx, key, dht.self)
+	dht.learnedProvider(key)
 	if !brdcst {
 		return nil
 	}
@@ -255,41 +268,98 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key *cid.Cid, brdcst bool) erro
 		return err
 	}
 
-	mes, err := dht.makeProvRecord(key)
-	if err != nil {
+	// fail early if we have no addresses to announce
+	if _, err := dht.provPeerInfo(); err != nil {
 		return err
 	}
 
+	var total, skipped int32
 	wg := sync.WaitGroup{}
 	for p := range peers {
 		wg.Add(1)
+		total++
 		go func(p peer.ID) {
 			defer wg.Done()
+			mes, err := dht.makeProvRecord(key, p)
+			if err == errNoSharedAddrs {
+				log.Debugf("not announcing %s to %s: %s", key, p, err)
+				atomic.AddInt32(&skipped, 1)
+				return
+			}
+			if err != nil {
+				log.Debug(err)
+				return
+			}
+
 			log.Debugf("putProvider(%s, %s)", key, p)
-			err := dht.sendMessage(ctx, p, mes)
+			err = dht.sendMessage(ctx, p, mes)
 			if err != nil {
 				log.Debug(err)
 			}
 		}(p)
 	}
 	wg.Wait()
+
+	// none of the closest peers could have reached us
+	if total > 0 && skipped == total {
+		return fmt.Errorf("provide %s: %s", key, errNoSharedAddrs)
+	}
 	return nil
 }
-func (dht *IpfsDHT) makeProvRecord(skey *cid.Cid) (*pb.Message, error) {
+
+// StopProviding removes the local provider record for key, so this node no
+// longer answers GET_PROVIDERS requests for it and it is no longer among the
+// keys announced by this node. Records already stored by other peers are left
+// to expire.
+func (dht *IpfsDHT) StopProviding(ctx context.Context, key *cid.Cid) error {
+	defer log.EventBegin(ctx, "stopProviding", key).Done()
+
+	dht.providers.RemoveProvider(ctx, key, dht.self)
+	return ctx.Err()
+}
+
+// ProvidedKeys returns the keys this node currently provides, that is keys
+// announced with Provide and not withdrawn with StopProviding since.
+func (dht *IpfsDHT) ProvidedKeys(ctx context.Context) ([]*cid.Cid, error) {
+	recs, err := dht.providers.LocalProviderRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*cid.Cid, 0, len(recs))
+	for _, rec := range recs {
+		keys = append(keys, rec.Key)
+	}
+	return keys, nil
+}
+
+// makeProvRecord builds the provider record for skey we send to peer to.
+func (dht *IpfsDHT) makeProvRecord(skey *cid.Cid, to peer.ID) (*pb.Message, error) {
+	pi, err := dht.provPeerInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	pmes := pb.NewMessage(pb.Message_ADD_PROVIDER, skey.KeyString(), 0)
+	pmes.ProviderPeers, err = dht.providerPBPeers(to, pi)
+	if err != nil {
+		return nil, err
+	}
+	return pmes, nil
+}
+
+// provPeerInfo returns the peer info we announce in provider records.
+func (dht *IpfsDHT) provPeerInfo() (pstore.PeerInfo, error) {
 	pi := pstore.PeerInfo{
 		ID:    dht.self,
 		Addrs: dht.host.Addrs(),
 	}
 
-	// // only share WAN-friendly addresses ??
-	// pi.Addrs = addrutil.WANShareableAddrs(pi.Addrs)
+	// addresses are filtered per recipient, see filterPeerInfo
 	if len(pi.Addrs) < 1 {
-		return nil, fmt.Errorf("no known addresses for self. cannot put provider.")
+		return pi, fmt.Errorf("no known addresses for self. cannot put provider.")
 	}
-
-	pmes := pb.NewMessage(pb.Message_ADD_PROVIDER, skey.KeyString(), 0)
-	pmes.ProviderPeers = pb.RawPeerInfosToPBPeers([]pstore.PeerInfo{pi})
-	return pmes, nil
+	return pi, nil
 }
 
 // FindProviders searches until the context expires.
@@ -305,22 +375,43 @@ func (dht *IpfsDHT) FindProviders(ctx context.Context, c *cid.Cid) ([]pstore.Pee
 // Peers will be returned on the channel as soon as they are found, even before
 // the search query completes.
 func (dht *IpfsDHT) FindProvidersAsync(ctx context.Context, key *cid.Cid, count int) <-chan pstore.PeerInfo {
-	log.Event(ctx, "findProviders", key)
 	peerOut := make(chan pstore.PeerInfo, count)
+	infos := dht.FindProviderInfosAsync(ctx, key, count)
+	go func() {
+		defer close(peerOut)
+		for pi := range infos {
+			select {
+			case peerOut <- pi.PeerInfo:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return peerOut
+}
+
+// FindProviderInfosAsync is like FindProvidersAsync, but also returns when
+// each provider record expires, as reported by the peer that returned it.
+// The expiry is zero if the responder did not report it.
+func (dht *IpfsDHT) FindProviderInfosAsync(ctx context.Context, key *cid.Cid, count int) <-chan providers.ProviderInfo {
+	log.Event(ctx, "findProviders", key)
+	peerOut := make(chan providers.ProviderInfo, count)
 	go dht.findProvidersAsyncRoutine(ctx, key, count, peerOut)
 	return peerOut
 }
 
-func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key *cid.Cid, count int, peerOut chan pstore.PeerInfo) {
+func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key *cid.Cid, count int, peerOut chan providers.ProviderInfo) {
 	defer log.EventBegin(ctx, "findProvidersAsync", key).Done()
 	defer close(peerOut)
 
 	ps := pset.NewLimited(count)
-	provs := dht.providers.GetProviders(ctx, key)
-	for _, p := range provs {
+	provs := dht.providers.GetProviderInfos(ctx, key)
+	for _, pi := range provs {
 		// NOTE: Assuming that this list of peers is unique
-		if ps.TryAdd(p) {
-			pi := dht.peerstore.PeerInfo(p)
+		if ps.TryAdd(pi.ID) {
+			if len(pi.Addrs) == 0 {
+				pi.Addrs = dht.peerstore.Addrs(pi.ID)
+			}
 			select {
 			case peerOut <- pi:
 			case <-ctx.Done():
@@ -335,6 +426,13 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key *cid.Cid,
 		}
 	}
 
+	// Skip the network if a recent lookup for this key found nothing
+	nc := dht.providerNegativeCache()
+	if ps.Size() == 0 && nc != nil && nc.has(key) {
+		log.Debugf("negative cache hit for %s", key)
+		return
+	}
+
 	// setup the Query
 	parent := ctx
 	query := dht.newQuery(key.KeyString(), func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
@@ -348,19 +446,23 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key *cid.Cid,
 		}
 
 		log.Debugf("%d provider entries", len(pmes.GetProviderPeers()))
-		provs := pb.PBPeersToPeerInfos(pmes.GetProviderPeers())
-		log.Debugf("%d provider entries decoded", len(provs))
 
 		// Add unique providers from request, up to 'count'
-		for _, prov := range provs {
+		now := time.Now()
+		for _, pbp := range pmes.GetProviderPeers() {
+			prov := pb.PBPeerToPeerInfo(pbp)
 			if prov.ID != dht.self {
 				dht.peerstore.AddAddrs(prov.ID, prov.Addrs, pstore.TempAddrTTL)
 			}
 			log.Debugf("got provider: %s", prov)
 			if ps.TryAdd(prov.ID) {
 				log.Debugf("using provider: %s", prov)
+				pi := providers.ProviderInfo{PeerInfo: *prov}
+				if validity := pbp.ValidityDuration(); validity > 0 {
+					pi.Expires = now.Add(validity)
+				}
 				select {
-				case peerOut <- *prov:
+				case peerOut <- pi:
 				case <-ctx.Done():
 					log.Debug("context timed out sending more providers")
 					return nil, ctx.Err()
@@ -387,6 +489,9 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key *cid.Cid,
 
 	peers := dht.routingTable.NearestPeers(kb.ConvertKey(key.KeyString()), AlphaValue)
 	_, err := query.Run(ctx, peers)
+	if ps.Size() == 0 && nc != nil && ctx.Err() == nil && (err == nil || err == routing.ErrNotFound) {
+		nc.add(key)
+	}
 	if err != nil {
 		log.Debugf("Query error: %s", err)
 		// Special handling for issue: https://github.com/ipfs/go-ipfs/issues/3032
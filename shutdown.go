@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"errors"
+	"time"
+)
+
+// ShutdownTimeout is how long Close waits for in-flight requests, inbound and
+// outbound, to finish before cancelling them.
+var ShutdownTimeout = 10 * time.Second
+
+// ErrClosed is returned by operations started after Close was called.
+var ErrClosed = errors.New("dht is closed")
+
+// startWork registers a piece of work Close should wait for, and reports
+// whether it may go ahead. Once Close was called, no new work is taken on.
+// Work that went ahead must call doneWork when it is finished.
+func (dht *IpfsDHT) startWork() bool {
+	dht.worklk.Lock()
+	defer dht.worklk.Unlock()
+	if dht.shutdown {
+		return false
+	}
+	dht.work.Add(1)
+	return true
+}
+
+func (dht *IpfsDHT) doneWork() {
+	dht.work.Done()
+}
+
+// goTracked runs f in a goroutine Close waits for. It returns false, without
+// running f, once Close was called.
+func (dht *IpfsDHT) goTracked(f func()) bool {
+	if !dht.startWork() {
+		return false
+	}
+	go func() {
+		defer dht.doneWork()
+		f()
+	}()
+	return true
+}
+
+// closing reports whether Close was called.
+func (dht *IpfsDHT) closing() bool {
+	dht.worklk.Lock()
+	defer dht.worklk.Unlock()
+	return dht.shutdown
+}
+
+// stopAccepting makes the DHT turn down new streams and work. Clients never
+// registered stream handlers, so they leave those of the host alone.
+func (dht *IpfsDHT) stopAccepting() {
+	dht.worklk.Lock()
+	defer dht.worklk.Unlock()
+	if dht.shutdown {
+		return
+	}
+	dht.shutdown = true
+
+	if dht.serving {
+		dht.host.RemoveStreamHandler(ProtocolDHT)
+		dht.host.RemoveStreamHandler(ProtocolDHTOld)
+	}
+}
+
+// waitForWork waits up to timeout for the work in flight to finish, and
+// reports whether it did.
+func (dht *IpfsDHT) waitForWork(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		dht.work.Wait()
+		close(done)
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
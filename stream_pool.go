@@ -0,0 +1,145 @@
+package dht
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// MaxStreamsPerPeer caps the number of streams we keep open to a single peer
+// for our own requests.
+var MaxStreamsPerPeer = 4
+
+const (
+	// senders that were not used for this long are closed
+	senderIdleTimeout   = 2 * time.Minute
+	senderSweepInterval = time.Minute
+)
+
+// StreamPoolStats counts how the per-peer stream pools are used.
+type StreamPoolStats struct {
+	Hits   uint64 // a request got a sender that was already open
+	Misses uint64 // a request needed a new sender
+	Resets uint64 // a stream was closed to be replaced
+}
+
+// errSenderClosed is returned by senders that were closed while a request
+// still held them.
+var errSenderClosed = errors.New("message sender closed")
+
+// senderPool holds the message senders for one peer.
+type senderPool struct {
+	senders []*messageSender
+}
+
+// messageSenderForPeer hands out a sender for p. It prefers an idle sender,
+// then opens a new one while the pool has room, and otherwise shares the
+// least busy sender. Senders must be given back with releaseMessageSender.
+func (dht *IpfsDHT) messageSenderForPeer(p peer.ID) *messageSender {
+	dht.smlk.Lock()
+	defer dht.smlk.Unlock()
+
+	pool, ok := dht.strmap[p]
+	if !ok {
+		pool = &senderPool{}
+		dht.strmap[p] = pool
+	}
+
+	var best *messageSender
+	for _, ms := range pool.senders {
+		if best == nil || ms.inflight < best.inflight {
+			best = ms
+		}
+	}
+
+	if best == nil || (best.inflight > 0 && len(pool.senders) < MaxStreamsPerPeer) {
+		atomic.AddUint64(&dht.poolStats.Misses, 1)
+		best = dht.newMessageSender(p)
+		pool.senders = append(pool.senders, best)
+	} else {
+		atomic.AddUint64(&dht.poolStats.Hits, 1)
+	}
+
+	best.inflight++
+	best.lastUsed = time.Now()
+	return best
+}
+
+// releaseMessageSender gives back a sender handed out by messageSenderForPeer.
+func (dht *IpfsDHT) releaseMessageSender(ms *messageSender) {
+	dht.smlk.Lock()
+	defer dht.smlk.Unlock()
+
+	ms.inflight--
+	ms.lastUsed = time.Now()
+}
+
+// sweepIdleSenders closes the senders that have not been used for a while.
+func (dht *IpfsDHT) sweepIdleSenders() {
+	dht.smlk.Lock()
+	var idle []*messageSender
+	for p, pool := range dht.strmap {
+		keep := pool.senders[:0]
+		for _, ms := range pool.senders {
+			if ms.inflight == 0 && time.Since(ms.lastUsed) > senderIdleTimeout {
+				idle = append(idle, ms)
+			} else {
+				keep = append(keep, ms)
+			}
+		}
+		pool.senders = keep
+		if len(keep) == 0 {
+			delete(dht.strmap, p)
+		}
+	}
+	dht.smlk.Unlock()
+
+	for _, ms := range idle {
+		ms.close()
+	}
+}
+
+// dropMessageSenders closes all senders for p, once we lost our connection
+// to it.
+func (dht *IpfsDHT) dropMessageSenders(p peer.ID) {
+	dht.smlk.Lock()
+	pool, ok := dht.strmap[p]
+	delete(dht.strmap, p)
+	dht.smlk.Unlock()
+
+	if ok {
+		pool.close()
+	}
+}
+
+// closeMessageSenders closes the senders for all peers.
+func (dht *IpfsDHT) closeMessageSenders() {
+	dht.smlk.Lock()
+	pools := dht.strmap
+	dht.strmap = make(map[peer.ID]*senderPool)
+	dht.smlk.Unlock()
+
+	for _, pool := range pools {
+		pool.close()
+	}
+}
+
+// close closes the pool's senders. Senders still in use may hold their lock
+// until a request times out, so they are closed in the background; requests
+// made with them afterwards fail with errSenderClosed.
+func (pool *senderPool) close() {
+	for _, ms := range pool.senders {
+		go ms.close()
+	}
+}
+
+// StreamPoolStats returns the usage counters of the per-peer stream pools.
+func (dht *IpfsDHT) StreamPoolStats() StreamPoolStats {
+	return StreamPoolStats{
+		Hits:   atomic.LoadUint64(&dht.poolStats.Hits),
+		Misses: atomic.LoadUint64(&dht.poolStats.Misses),
+		Resets: atomic.LoadUint64(&dht.poolStats.Resets),
+	}
+}
@@ -2,6 +2,8 @@ package dht
 
 import (
 	"sync"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
 )
 
 // Pool size is the number of nodes used for group find/set RPC calls
@@ -37,3 +39,26 @@ func (c *counter) Size() (s int) {
 	c.mut.Unlock()
 	return
 }
+
+// commonPrefixLen returns the number of leading bits a and b have in common.
+func commonPrefixLen(a, b kb.ID) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	for i := 0; i < n; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			continue
+		}
+
+		cpl := i * 8
+		for x&0x80 == 0 {
+			x <<= 1
+			cpl++
+		}
+		return cpl
+	}
+	return n * 8
+}